@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SensorStatus is a configured sensor with the values of its latest reading,
+// which are null as long as the sensor has not been received.
+type SensorStatus struct {
+	ID          string            `json:"id"`
+	Location    string            `json:"location"`
+	Protocol    string            `json:"protocol"`
+	Placement   string            `json:"placement,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Channel     *int              `json:"channel"`
+	Temperature *float64          `json:"temperature"`
+	Humidity    *float64          `json:"humidity"`
+	LowBattery  *bool             `json:"low_battery"`
+	LastSeen    *time.Time        `json:"last_seen"`
+	// Stale is true if the sensor has not been received within its stale timeout
+	Stale bool `json:"stale"`
+}
+
+// apiError is the body of all error responses of the API.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func sensorStatus(s *SensorConfig, r *Reading, now time.Time) SensorStatus {
+	status := SensorStatus{
+		ID:        s.ID,
+		Location:  s.Location,
+		Protocol:  s.Protocol,
+		Placement: s.Placement,
+		Labels:    s.Labels,
+		Stale:     true,
+	}
+	if r != nil {
+		status.Channel = &r.Channel
+		status.Temperature = &r.Temperature
+		status.Humidity = &r.Humidity
+		status.LowBattery = &r.LowBattery
+		status.LastSeen = &r.Time
+		status.Stale = r.Stale(now)
+	}
+	return status
+}
+
+// sensorsHandler serves all configured sensors with their latest values as JSON.
+func (e *Exporter) sensorsHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	sensors := []SensorStatus{}
+	for _, id := range e.config.SensorIDs() {
+		sensors = append(sensors, sensorStatus(e.config.Sensors[id], e.readings.Get(id), now))
+	}
+	serveJSON(w, r, http.StatusOK, sensors)
+}
+
+// sensorHandler serves a single sensor, given by the path /api/sensors/{id}, as JSON.
+func (e *Exporter) sensorHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/sensors/")
+	s, ok := e.config.Sensors[id]
+	if !ok {
+		serveJSON(w, r, http.StatusNotFound, apiError{"sensor " + id + " is not configured"})
+		return
+	}
+	serveJSON(w, r, http.StatusOK, sensorStatus(s, e.readings.Get(id), time.Now()))
+}
+
+// historyResponse is the history of a sensor, either the readings or,
+// if downsampled, buckets with aggregated readings.
+type historyResponse struct {
+	Sensor   string      `json:"sensor"`
+	Location string      `json:"location"`
+	From     time.Time   `json:"from"`
+	To       time.Time   `json:"to"`
+	Step     string      `json:"step,omitempty"`
+	Points   interface{} `json:"points"`
+}
+
+// historyHandler serves the readings of the sensor given by the query parameter sensor
+// kept in memory, or in the store if configured, between from and to (by default the retention
+// of the in-memory history), downsampled into buckets if a step is given.
+func (e *Exporter) historyHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	id := query.Get("sensor")
+	if id == "" {
+		serveJSON(w, r, http.StatusBadRequest, apiError{"parameter sensor is missing"})
+		return
+	}
+	s, ok := e.config.Sensors[id]
+	if !ok {
+		serveJSON(w, r, http.StatusNotFound, apiError{"sensor " + id + " is not configured"})
+		return
+	}
+
+	now := time.Now().UTC()
+	to, err := parseTimeParam(query.Get("to"), now)
+	if err != nil {
+		serveJSON(w, r, http.StatusBadRequest, apiError{"invalid parameter to: " + err.Error()})
+		return
+	}
+	from, err := parseTimeParam(query.Get("from"), to.Add(-e.config.History.Retention))
+	if err != nil {
+		serveJSON(w, r, http.StatusBadRequest, apiError{"invalid parameter from: " + err.Error()})
+		return
+	}
+	if from.After(to) {
+		serveJSON(w, r, http.StatusBadRequest, apiError{"parameter from is after to"})
+		return
+	}
+
+	var step time.Duration
+	if param := query.Get("step"); param != "" {
+		step, err = time.ParseDuration(param)
+		if err != nil || step <= 0 {
+			serveJSON(w, r, http.StatusBadRequest, apiError{"invalid parameter step: " + param})
+			return
+		}
+		// buckets of the store can't be split into smaller ones
+		if e.store != nil && step < e.config.Store.Step {
+			serveJSON(w, r, http.StatusBadRequest,
+				apiError{"parameter step must be at least the step of the store " + e.config.Store.Step.String()})
+			return
+		}
+	}
+
+	var buckets []HistoryBucket
+	var points []HistoryPoint
+	if e.store != nil {
+		buckets, points, err = e.store.Get(id, from, to)
+		if err != nil {
+			log.Println(err)
+			serveJSON(w, r, http.StatusInternalServerError, apiError{err.Error()})
+			return
+		}
+	} else {
+		points = e.history.Get(id, from, to)
+	}
+
+	resp := historyResponse{Sensor: id, Location: s.Location, From: from, To: to}
+	if step > 0 {
+		for _, p := range points {
+			buckets = append(buckets, p.bucket())
+		}
+		resp.Step = step.String()
+		resp.Points = mergeBuckets(buckets, from, step)
+	} else {
+		// readings that have already been downsampled in the store are returned as averages
+		all := []HistoryPoint{}
+		for _, b := range buckets {
+			all = append(all, b.point())
+		}
+		resp.Points = append(all, points...)
+	}
+	serveJSON(w, r, http.StatusOK, resp)
+}
+
+// parseTimeParam parses an RFC 3339 time or a Unix timestamp in seconds,
+// like the Prometheus API does, and returns def if the parameter is not set.
+func parseTimeParam(param string, def time.Time) (time.Time, error) {
+	if param == "" {
+		return def, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, param); err == nil {
+		return t, nil
+	}
+	seconds, err := strconv.ParseFloat(param, 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return time.Time{}, fmt.Errorf("%q is neither an RFC 3339 time nor a Unix timestamp", param)
+	}
+	sec, frac := math.Modf(seconds)
+	return time.Unix(int64(sec), int64(frac*1e9)).UTC(), nil
+}
+
+// serveJSON writes v as JSON response to GET and HEAD requests. Successful responses
+// have an ETag, so that clients can revalidate them with If-None-Match.
+func serveJSON(w http.ResponseWriter, r *http.Request, code int, v interface{}) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		code, v = http.StatusMethodNotAllowed, apiError{"method " + r.Method + " is not allowed"}
+	}
+
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	body = append(body, '\n')
+
+	w.Header().Set("Content-Type", "application/json")
+	if code == http.StatusOK {
+		sum := sha256.Sum256(body)
+		etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "no-cache")
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	w.WriteHeader(code)
+	if r.Method != http.MethodHead {
+		if _, err := w.Write(body); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// etagMatches checks whether the value of an If-None-Match header matches etag,
+// using the weak comparison required for If-None-Match.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestAPIExporter(t *testing.T) *Exporter {
+	c, err := parseConfigString(`
+sensors:
+  91:
+    location: fridge
+    protocol: weather12
+    placement: indoor
+    labels:
+      floor: ground
+  92:
+    location: garden
+    protocol: weather12
+`)
+	require.NoError(t, err)
+	return newTestExporter(t, c)
+}
+
+func get(e *Exporter, path string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", path, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	e.Handler().ServeHTTP(w, r)
+	return w
+}
+
+func TestSensorsHandler(t *testing.T) {
+	e := newTestAPIExporter(t)
+	now := time.Now().UTC().Truncate(time.Second)
+	e.handleReading(&Reading{Sensor: e.config.Sensors["91"], Channel: 1, Temperature: 4.2, Humidity: 60, Time: now})
+
+	w := get(e, "/api/sensors")
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `[
+  {"id": "91", "location": "fridge", "protocol": "weather12", "placement": "indoor",
+   "labels": {"floor": "ground"}, "channel": 1, "temperature": 4.2, "humidity": 60,
+   "low_battery": false, "last_seen": "`+now.Format(time.RFC3339)+`", "stale": false},
+  {"id": "92", "location": "garden", "protocol": "weather12", "channel": null, "temperature": null,
+   "humidity": null, "low_battery": null, "last_seen": null, "stale": true}
+]`, w.Body.String())
+}
+
+func TestSensorsHandler_etag(t *testing.T) {
+	e := newTestAPIExporter(t)
+
+	w := get(e, "/api/sensors")
+	etag := w.Header().Get("ETag")
+	require.NotEmpty(t, etag)
+
+	w = get(e, "/api/sensors", "If-None-Match", etag)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Empty(t, w.Body.String())
+
+	w = get(e, "/api/sensors", "If-None-Match", `"other", W/`+etag)
+	assert.Equal(t, http.StatusNotModified, w.Code, "Weak comparison of a list of ETags")
+
+	e.handleReading(&Reading{Sensor: e.config.Sensors["92"], Temperature: 12, Humidity: 80, Time: time.Now()})
+
+	w = get(e, "/api/sensors", "If-None-Match", etag)
+	assert.Equal(t, http.StatusOK, w.Code, "Sensors have changed")
+	assert.NotEqual(t, etag, w.Header().Get("ETag"))
+}
+
+func TestSensorHandler(t *testing.T) {
+	e := newTestAPIExporter(t)
+	e.handleReading(&Reading{Sensor: e.config.Sensors["92"], Temperature: 12, Humidity: 80, LowBattery: true,
+		Time: time.Now()})
+
+	w := get(e, "/api/sensors/92")
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEmpty(t, w.Header().Get("ETag"))
+	var s SensorStatus
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &s))
+	assert.Equal(t, "garden", s.Location)
+	assert.Equal(t, 12.0, *s.Temperature)
+	assert.True(t, *s.LowBattery)
+	assert.False(t, s.Stale)
+}
+
+func TestSensorHandler_notFound(t *testing.T) {
+	e := newTestAPIExporter(t)
+
+	w := get(e, "/api/sensors/93")
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Empty(t, w.Header().Get("ETag"))
+	assert.JSONEq(t, `{"error": "sensor 93 is not configured"}`, w.Body.String())
+}
+
+func TestSensorsHandler_methodNotAllowed(t *testing.T) {
+	e := newTestAPIExporter(t)
+	w := httptest.NewRecorder()
+
+	e.Handler().ServeHTTP(w, httptest.NewRequest("POST", "/api/sensors", nil))
+
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, "GET, HEAD", w.Header().Get("Allow"))
+}
+
+func TestHistoryHandler(t *testing.T) {
+	e := newTestAPIExporter(t)
+	for i, temperature := range []float64{4, 6, 5} {
+		e.handleReading(&Reading{Sensor: e.config.Sensors["91"], Temperature: temperature, Humidity: 60,
+			Time: testTime.Add(time.Duration(i) * 2 * time.Minute)})
+	}
+
+	w := get(e, "/api/history?sensor=91&from=2019-10-06T21:29:00Z&to=1570397488")
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"sensor": "91", "location": "fridge",
+		"from": "2019-10-06T21:29:00Z", "to": "2019-10-06T21:31:28Z",
+		"points": [
+			{"time": "2019-10-06T21:29:28Z", "temperature": 4, "humidity": 60},
+			{"time": "2019-10-06T21:31:28Z", "temperature": 6, "humidity": 60}
+		]}`, w.Body.String())
+}
+
+func TestHistoryHandler_step(t *testing.T) {
+	e := newTestAPIExporter(t)
+	for i, temperature := range []float64{4, 6, 5} {
+		e.handleReading(&Reading{Sensor: e.config.Sensors["91"], Temperature: temperature, Humidity: 60,
+			Time: testTime.Add(time.Duration(i) * 2 * time.Minute)})
+	}
+
+	w := get(e, "/api/history?sensor=91&from=2019-10-06T21:29:00Z&to=2019-10-06T22:00:00Z&step=3m")
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"sensor": "91", "location": "fridge",
+		"from": "2019-10-06T21:29:00Z", "to": "2019-10-06T22:00:00Z", "step": "3m0s",
+		"points": [
+			{"time": "2019-10-06T21:29:00Z", "count": 2,
+			 "temperature": {"min": 4, "max": 6, "avg": 5}, "humidity": {"min": 60, "max": 60, "avg": 60}},
+			{"time": "2019-10-06T21:32:00Z", "count": 1,
+			 "temperature": {"min": 5, "max": 5, "avg": 5}, "humidity": {"min": 60, "max": 60, "avg": 60}}
+		]}`, w.Body.String())
+}
+
+func TestHistoryHandler_empty(t *testing.T) {
+	e := newTestAPIExporter(t)
+
+	w := get(e, "/api/history?sensor=92")
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp historyResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, []interface{}{}, resp.Points)
+	assert.Equal(t, 24*time.Hour, resp.To.Sub(resp.From), "Defaults to the whole history")
+}
+
+func TestHistoryHandler_invalid(t *testing.T) {
+	e := newTestAPIExporter(t)
+
+	for query, expected := range map[string]string{
+		"":                               `{"error": "parameter sensor is missing"}`,
+		"sensor=91&from=yesterday":       `{"error": "invalid parameter from: \"yesterday\" is neither an RFC 3339 time nor a Unix timestamp"}`,
+		"sensor=91&from=1570397488&to=1": `{"error": "parameter from is after to"}`,
+		"sensor=91&step=0s":              `{"error": "invalid parameter step: 0s"}`,
+	} {
+		w := get(e, "/api/history?"+query)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+		assert.JSONEq(t, expected, w.Body.String(), query)
+	}
+
+	w := get(e, "/api/history?sensor=93")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
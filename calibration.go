@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Calibration corrects the values of a sensor, separately for each quantity.
+type Calibration struct {
+	Temperature Correction `mapstructure:"temperature"`
+	Humidity    Correction `mapstructure:"humidity"`
+}
+
+// Correction is a linear correction of a measured value. It is either
+// given as a gain and/or an additive offset, i.e. value * gain + offset,
+// or as two calibration points, i.e. pairs of a raw value measured by
+// the sensor and the actual (reference) value.
+type Correction struct {
+	Offset float64            `mapstructure:"offset"`
+	Gain   *float64           `mapstructure:"gain"`
+	Points []CalibrationPoint `mapstructure:"points"`
+}
+
+// CalibrationPoint is a raw value measured by a sensor
+// and the actual value measured by a reference.
+type CalibrationPoint struct {
+	Raw    float64 `mapstructure:"raw"`
+	Actual float64 `mapstructure:"actual"`
+}
+
+// Apply returns the corrected value.
+func (c Correction) Apply(value float64) float64 {
+	if len(c.Points) == 2 {
+		p1, p2 := c.Points[0], c.Points[1]
+		gain := (p2.Actual - p1.Actual) / (p2.Raw - p1.Raw)
+		return p1.Actual + (value-p1.Raw)*gain
+	}
+
+	if c.Gain != nil {
+		value *= *c.Gain
+	}
+	return value + c.Offset
+}
+
+// clampHumidity limits a corrected relative humidity to 0-100 %,
+// as an offset or gain can push values near the limits beyond them.
+func clampHumidity(value float64) float64 {
+	return math.Max(0, math.Min(100, value))
+}
+
+func (c Correction) validate() error {
+	if len(c.Points) == 0 {
+		if c.Gain != nil && *c.Gain == 0 {
+			return errors.New("gain must not be 0")
+		}
+		return nil
+	}
+
+	if c.Gain != nil || c.Offset != 0 {
+		return errors.New("either use calibration points or gain/offset, not both")
+	}
+	if len(c.Points) != 2 {
+		return fmt.Errorf("two calibration points are needed, got %d", len(c.Points))
+	}
+	if c.Points[0].Raw == c.Points[1].Raw {
+		return errors.New("calibration points must have different raw values")
+	}
+	return nil
+}
+
+func (c Calibration) validate() []error {
+	var errs []error
+	if err := c.Temperature.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("temperature: %v", err))
+	}
+	if err := c.Humidity.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("humidity: %v", err))
+	}
+	return errs
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCorrection_Apply(t *testing.T) {
+	gain := 0.5
+
+	assert.Equal(t, 21.5, Correction{}.Apply(21.5), "No correction")
+	assert.Equal(t, 20.7, Correction{Offset: -0.8}.Apply(21.5), "Offset only")
+	assert.Equal(t, 25.0, Correction{Gain: &gain}.Apply(50), "Gain only")
+	assert.Equal(t, 27.0, Correction{Gain: &gain, Offset: 2}.Apply(50), "Gain and offset")
+}
+
+func TestCorrection_ApplyTwoPoints(t *testing.T) {
+	c := Correction{
+		Points: []CalibrationPoint{
+			{Raw: 30, Actual: 33},
+			{Raw: 70, Actual: 75},
+		},
+	}
+
+	assert.InDelta(t, 33.0, c.Apply(30), 1e-9)
+	assert.InDelta(t, 75.0, c.Apply(70), 1e-9)
+	assert.InDelta(t, 54.0, c.Apply(50), 1e-9)
+}
+
+func TestCalibration_validate(t *testing.T) {
+	zero := 0.0
+
+	assert.Empty(t, Calibration{}.validate())
+
+	errs := Calibration{
+		Temperature: Correction{Gain: &zero},
+		Humidity: Correction{
+			Offset: 1,
+			Points: []CalibrationPoint{{Raw: 30, Actual: 33}},
+		},
+	}.validate()
+	assert.Len(t, errs, 2)
+	assert.EqualError(t, errs[0], "temperature: gain must not be 0")
+	assert.EqualError(t, errs[1], "humidity: either use calibration points or gain/offset, not both")
+
+	errs = Calibration{
+		Humidity: Correction{Points: []CalibrationPoint{{Raw: 30, Actual: 33}}},
+	}.validate()
+	assert.EqualError(t, errs[0], "humidity: two calibration points are needed, got 1")
+
+	errs = Calibration{
+		Humidity: Correction{Points: []CalibrationPoint{{Raw: 30, Actual: 33}, {Raw: 30, Actual: 35}}},
+	}.validate()
+	assert.EqualError(t, errs[0], "humidity: calibration points must have different raw values")
+}
@@ -1,12 +1,83 @@
 package main
 
 import (
-	"github.com/spf13/viper"
+	"fmt"
 	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
 )
 
 var vip = viper.New()
 
+// Config is the typed representation of the config file,
+// parsed and validated once at startup.
+type Config struct {
+	Sensors map[string]*SensorConfig `mapstructure:"-"`
+	// ExportRawValues additionally exports the uncalibrated values of all sensors
+	ExportRawValues bool `mapstructure:"export_raw_values"`
+	// DerivedMetrics are the names of metrics computed from temperature and humidity
+	DerivedMetrics []string          `mapstructure:"derived_metrics"`
+	Ventilation    VentilationConfig `mapstructure:"ventilation"`
+	// MoldRiskStateFile persists the mold index of sensors across restarts
+	MoldRiskStateFile string `mapstructure:"mold_risk_state_file"`
+	// ReadingsStateFile persists the latest reading of each sensor across restarts
+	ReadingsStateFile string `mapstructure:"readings_state_file"`
+	// StaleTimeout is the default time after which the values of a sensor
+	// that has not been received are no longer exported
+	StaleTimeout time.Duration `mapstructure:"stale_timeout"`
+	// Ignore silences signals of sensors that are not configured
+	Ignore      []IgnoreRule      `mapstructure:"ignore"`
+	History     HistoryConfig     `mapstructure:"history"`
+	Store       StoreConfig       `mapstructure:"store"`
+	Metrics     MetricsConfig     `mapstructure:"metrics"`
+	Pushgateway PushgatewayConfig `mapstructure:"pushgateway"`
+	RemoteWrite RemoteWriteConfig `mapstructure:"remote_write"`
+	MQTT        MQTTConfig        `mapstructure:"mqtt"`
+	InfluxDB    InfluxDBConfig    `mapstructure:"influxdb"`
+	Graphite    GraphiteConfig    `mapstructure:"graphite"`
+	StatsD      StatsDConfig      `mapstructure:"statsd"`
+	OTLP        OTLPConfig        `mapstructure:"otlp"`
+	// Sinks configures the queues of the outputs readings are sent to, keyed by output
+	Sinks map[string]SinkConfig `mapstructure:"sinks"`
+}
+
+// SensorConfig is the configuration of a single sensor.
+type SensorConfig struct {
+	ID          string      `mapstructure:"-"`
+	Location    string      `mapstructure:"location"`
+	Protocol    string      `mapstructure:"protocol"`
+	Calibration Calibration `mapstructure:"calibration"`
+	// Placement is either indoor or outdoor (optional)
+	Placement string `mapstructure:"placement"`
+	// MoldRisk enables tracking the mold index
+	MoldRisk bool `mapstructure:"mold_risk"`
+	// StaleTimeout overrides the default stale timeout for this sensor
+	StaleTimeout time.Duration `mapstructure:"stale_timeout"`
+	// Interval is the time between two transmissions of the sensor (learned if not set)
+	Interval time.Duration `mapstructure:"interval"`
+	// Labels are constant labels added to all metrics of the sensor
+	Labels map[string]string `mapstructure:"labels"`
+}
+
+// ValidationErrors collects all problems found in a config file,
+// so that they can be reported at once.
+type ValidationErrors []error
+
+func (v ValidationErrors) Error() string {
+	msgs := make([]string, len(v))
+	for i, err := range v {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
 func initConfig(configFile string) {
 	vip.SetConfigType("yaml")
 	if configFile != "" {
@@ -18,16 +89,295 @@ func initConfig(configFile string) {
 		vip.AddConfigPath(".")
 	}
 	vip.SetDefault("sensors", map[string]string{})
+	vip.SetDefault("ventilation.min_difference", 1.0)
+	vip.SetDefault("stale_timeout", "10m")
+	vip.SetDefault("history.retention", "24h")
+	vip.SetDefault("history.limit", 4096)
+	vip.SetDefault("store.retention", "8760h")
+	vip.SetDefault("store.raw_retention", "168h")
+	vip.SetDefault("store.step", "1h")
+	vip.SetDefault("metrics.go_collector", true)
+	vip.SetDefault("metrics.process_collector", true)
+	vip.SetDefault("metrics.namespace", "meter")
+	vip.SetDefault("metrics.humidity_unit", HumidityPercent)
+	vip.SetDefault("pushgateway.job", "weather-station")
+	vip.SetDefault("pushgateway.interval", "1m")
+	vip.SetDefault("remote_write.interval", "1m")
+	vip.SetDefault("remote_write.timeout", "10s")
+	vip.SetDefault("remote_write.retries", 3)
+	vip.SetDefault("remote_write.buffer_size", 10000)
+	vip.SetDefault("mqtt.client_id", "weather-station")
+	vip.SetDefault("mqtt.topic_prefix", "weather-station")
+	vip.SetDefault("mqtt.timeout", "10s")
+	vip.SetDefault("mqtt.home_assistant.discovery_prefix", "homeassistant")
+	vip.SetDefault("influxdb.version", 1)
+	vip.SetDefault("influxdb.measurement", "weather")
+	vip.SetDefault("influxdb.batch_size", 100)
+	vip.SetDefault("influxdb.flush_interval", "10s")
+	vip.SetDefault("influxdb.timeout", "10s")
+	vip.SetDefault("influxdb.retries", 3)
+	vip.SetDefault("influxdb.buffer_size", 10000)
+	vip.SetDefault("graphite.path_template", "weather.{location}.{quantity}")
+	vip.SetDefault("graphite.timeout", "10s")
+	vip.SetDefault("statsd.path_template", "weather.{location}.{quantity}")
+	vip.SetDefault("otlp.protocol", OTLPHTTPProtobuf)
+	vip.SetDefault("otlp.interval", "1m")
+	vip.SetDefault("otlp.timeout", "10s")
+	vip.SetDefault("otlp.retries", 3)
+	for _, name := range queuedSinks {
+		vip.SetDefault("sinks."+name+".queue_size", 1000)
+		vip.SetDefault("sinks."+name+".drop_policy", DropOldest)
+		vip.SetDefault("sinks."+name+".retries", 3)
+		vip.SetDefault("sinks."+name+".backoff", "1s")
+	}
 }
 
-func readConfig() {
+func readConfig() error {
 	err := vip.ReadInConfig()
 	if err != nil {
 		log.Println(err, "Error reading config file. Running in scanning mode.")
 	}
+	return err
 }
 
-func loadConfig(configFile string) {
+// loadConfig reads the config file and parses it into a Config.
+// A missing config file is not an error (the exporter runs in scanning mode),
+// but an invalid one is.
+func loadConfig(configFile string) (*Config, error) {
 	initConfig(configFile)
 	readConfig()
+	return parseConfig(vip)
+}
+
+// parseConfig decodes the settings of v into a Config and validates it.
+// All validation errors are returned at once as ValidationErrors.
+func parseConfig(v *viper.Viper) (*Config, error) {
+	var errs ValidationErrors
+
+	c := &Config{}
+	settings := v.AllSettings()
+	delete(settings, "sensors")
+	errs = append(errs, decodeErrors("config", decode(settings, c))...)
+
+	c.Sensors = map[string]*SensorConfig{}
+	for id := range v.GetStringMap("sensors") {
+		s := &SensorConfig{}
+		err := decode(v.Get("sensors."+id), s)
+		errs = append(errs, decodeErrors(fmt.Sprintf("sensor id %s", id), err)...)
+		s.ID = id
+		if s.StaleTimeout == 0 {
+			s.StaleTimeout = c.StaleTimeout
+		}
+		c.Sensors[id] = s
+	}
+
+	errs = append(errs, c.validate()...)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	return c, nil
+}
+
+// decode decodes a part of the config into output in the same way as viper does,
+// but fails on unknown keys, which are most likely typos.
+func decode(input interface{}, output interface{}) error {
+	d, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:           output,
+		WeaklyTypedInput: true,
+		ErrorUnused:      true,
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+		),
+	})
+	if err != nil {
+		return err
+	}
+	return d.Decode(input)
+}
+
+// decodeErrors splits an error returned by decoding a part of the config
+// into single errors, each prefixed with the part of the config it belongs to.
+func decodeErrors(prefix string, err error) ValidationErrors {
+	if err == nil {
+		return nil
+	}
+
+	merr, ok := err.(*mapstructure.Error)
+	if !ok {
+		return ValidationErrors{fmt.Errorf("%s: %v", prefix, err)}
+	}
+
+	errs := make(ValidationErrors, len(merr.Errors))
+	for i, msg := range merr.Errors {
+		errs[i] = fmt.Errorf("%s: %s", prefix, strings.TrimPrefix(msg, "'' "))
+	}
+	return errs
+}
+
+// validate checks that all required fields are set, protocols are known,
+// locations are unique and all values can safely be used as Prometheus labels.
+func (c *Config) validate() ValidationErrors {
+	var errs ValidationErrors
+
+	protocols := Protocols()
+	locations := map[string]string{}
+	outdoor := ""
+
+	if c.StaleTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("stale timeout must be positive, got %v", c.StaleTimeout))
+	}
+
+	for _, name := range c.DerivedMetrics {
+		if derivations[name] == nil {
+			errs = append(errs, fmt.Errorf("unknown derived metric %q (supported: %s)",
+				name, strings.Join(derivedMetricNames(), ", ")))
+		}
+	}
+
+	errs = append(errs, c.History.validate()...)
+	errs = append(errs, c.Store.validate()...)
+	errs = append(errs, c.Metrics.validate()...)
+	errs = append(errs, c.Pushgateway.validate()...)
+	errs = append(errs, c.RemoteWrite.validate()...)
+	errs = append(errs, c.MQTT.validate()...)
+	errs = append(errs, c.InfluxDB.validate()...)
+	errs = append(errs, c.Graphite.validate()...)
+	errs = append(errs, c.StatsD.validate()...)
+	errs = append(errs, c.OTLP.validate()...)
+	errs = append(errs, validateSinks(c.Sinks)...)
+	if c.Pushgateway.URL != "" && c.Metrics.Timestamps {
+		errs = append(errs, fmt.Errorf("pushgateway doesn't accept metrics with timestamps"))
+	}
+
+	for i, rule := range c.Ignore {
+		if rule.ID == "" {
+			errs = append(errs, fmt.Errorf("ignore rule %d has no id specified", i+1))
+		}
+		if rule.Protocol != "" && protocols[rule.Protocol] == nil {
+			errs = append(errs, fmt.Errorf("ignore rule %d has unknown protocol %q (supported: %s)",
+				i+1, rule.Protocol, strings.Join(protocolNames(), ", ")))
+		}
+	}
+
+	for _, id := range c.SensorIDs() {
+		s := c.Sensors[id]
+
+		if _, err := strconv.ParseUint(id, 10, 0); err != nil {
+			errs = append(errs, fmt.Errorf("sensor id %s is not a positive number", id))
+		}
+
+		if s.Location == "" {
+			errs = append(errs, fmt.Errorf("sensor id %s has no location specified", id))
+		} else if !labelSafe(s.Location) {
+			errs = append(errs, fmt.Errorf("sensor id %s has invalid location %q", id, s.Location))
+		} else if other, ok := locations[s.Location]; ok {
+			errs = append(errs, fmt.Errorf("sensor id %s has the same location %q as sensor id %s",
+				id, s.Location, other))
+		} else {
+			locations[s.Location] = id
+		}
+
+		if s.Protocol == "" {
+			errs = append(errs, fmt.Errorf("sensor id %s has no protocol specified", id))
+		} else if protocols[s.Protocol] == nil {
+			errs = append(errs, fmt.Errorf("sensor id %s has unknown protocol %q (supported: %s)",
+				id, s.Protocol, strings.Join(protocolNames(), ", ")))
+		}
+
+		switch s.Placement {
+		case "", Indoor:
+		case Outdoor:
+			if outdoor != "" {
+				errs = append(errs, fmt.Errorf("sensor id %s is placed outdoor, but sensor id %s is already",
+					id, outdoor))
+			}
+			outdoor = id
+		default:
+			errs = append(errs, fmt.Errorf("sensor id %s has invalid placement %q (supported: %s, %s)",
+				id, s.Placement, Indoor, Outdoor))
+		}
+
+		if s.StaleTimeout < 0 {
+			errs = append(errs, fmt.Errorf("sensor id %s has negative stale timeout %v", id, s.StaleTimeout))
+		}
+
+		if s.Interval != 0 && s.Interval < burstWindow {
+			errs = append(errs, fmt.Errorf("sensor id %s has interval %v, but it must be at least %v",
+				id, s.Interval, burstWindow))
+		}
+
+		for _, err := range s.Calibration.validate() {
+			errs = append(errs, fmt.Errorf("sensor id %s has invalid calibration: %v", id, err))
+		}
+
+		for _, err := range validateLabels(s.Labels) {
+			errs = append(errs, fmt.Errorf("sensor id %s has invalid labels: %v", id, err))
+		}
+		for _, name := range sortedKeys(s.Labels) {
+			if _, ok := c.Metrics.Labels[name]; ok {
+				errs = append(errs, fmt.Errorf("sensor id %s has label %s, which is already set for all metrics",
+					id, name))
+			}
+		}
+	}
+
+	return errs
+}
+
+// Ignored checks whether a signal of a sensor that is not configured,
+// decoded with the given protocol, is silenced by an ignore rule.
+func (c *Config) Ignored(protocol string, m *GTWT01Result) bool {
+	for _, rule := range c.Ignore {
+		if rule.Matches(protocol, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// SensorIDs returns the IDs of all configured sensors in ascending order.
+func (c *Config) SensorIDs() []string {
+	ids := make([]string, 0, len(c.Sensors))
+	for id := range c.Sensors {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// labelSafe checks whether s can be used as a label value,
+// i.e. it is valid UTF-8 without leading/trailing whitespace and control characters.
+func labelSafe(s string) bool {
+	if !utf8.ValidString(s) || strings.TrimSpace(s) != s {
+		return false
+	}
+	for _, r := range s {
+		if unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// sanitizeName replaces all characters except letters, digits, underscores and dashes,
+// e.g. to use s as ID in Home Assistant or as node of a Graphite path.
+func sanitizeName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// protocolNames returns the names of all supported protocols in ascending order.
+func protocolNames() []string {
+	names := make([]string, 0)
+	for name := range Protocols() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
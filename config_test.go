@@ -4,9 +4,12 @@ import (
 	"bytes"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"log"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestDefaultConfig(t *testing.T) {
@@ -18,9 +21,10 @@ func TestDefaultConfig(t *testing.T) {
 		log.SetOutput(os.Stderr)
 	}()
 
-	loadConfig("")
+	c, err := loadConfig("")
 
-	assert.Equal(t, len(vip.GetStringMap("sensors")), 0, "Should initialize empty sensor list")
+	assert.NoError(t, err)
+	assert.Equal(t, len(c.Sensors), 0, "Should initialize empty sensor list")
 	assert.Contains(t, buf.String(), "Not Found")
 
 }
@@ -34,7 +38,7 @@ func TestConfigWithSensors(t *testing.T) {
 		log.SetOutput(os.Stderr)
 	}()
 
-	loadSampleConfig()
+	c := loadSampleConfig()
 	sensors := vip.GetStringMap("sensors")
 	assert.Equal(t, len(sensors), 2, "Should initialize sensor list from config file")
 	assert.NotNil(t, sensors["91"], "Sensor 91 exists in config")
@@ -42,12 +46,224 @@ func TestConfigWithSensors(t *testing.T) {
 	assert.Equal(t, vip.GetString("sensors.1235.location"), "kitchen", "Sensor location is kitchen")
 	assert.Equal(t, vip.GetString("sensors.1235.maeh"), "", "Sensor location is kitchen")
 	assert.Equal(t, buf.String(), "")
+
+	assert.Equal(t, []string{"1235", "91"}, c.SensorIDs())
+	assert.Equal(t, &SensorConfig{ID: "91", Location: "fridge", Protocol: "weather12", StaleTimeout: 10 * time.Minute},
+		c.Sensors["91"])
 }
 
-func loadSampleConfig() {
+func TestParseConfig_reportsAllErrors(t *testing.T) {
+	_, err := parseConfigString(`
+sensors:
+  1235:
+    location: kitchen
+  91:
+    location: kitchen
+    protocol: weather99
+  abc:
+    protocol: weather15
+  92:
+    location: "fridge\n"
+    protocol: weather12
+    locaton: typo
+`)
+
+	require.Error(t, err)
+	errs, ok := err.(ValidationErrors)
+	require.True(t, ok, "Should return ValidationErrors")
+	assert.Len(t, errs, 7)
+	assert.Contains(t, err.Error(), "sensor id 92: has invalid keys: locaton")
+	assert.Contains(t, err.Error(), "sensor id 1235 has no protocol specified")
+	assert.Contains(t, err.Error(), `sensor id 91 has the same location "kitchen" as sensor id 1235`)
+	assert.Contains(t, err.Error(), `sensor id 91 has unknown protocol "weather99" (supported: weather12, weather15)`)
+	assert.Contains(t, err.Error(), `sensor id 92 has invalid location "fridge\n"`)
+	assert.Contains(t, err.Error(), "sensor id abc is not a positive number")
+	assert.Contains(t, err.Error(), "sensor id abc has no location specified")
+}
+
+func loadSampleConfig() *Config {
 	vip = viper.New()
 
 	initConfig("")
 	vip.SetConfigName("sample-weather-station")
 	readConfig()
+
+	c, err := parseConfig(vip)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+func parseConfigString(config string) (*Config, error) {
+	vip = viper.New()
+
+	initConfig("")
+	err := vip.ReadConfig(strings.NewReader(config))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseConfig(vip)
+}
+
+func TestParseConfig_calibration(t *testing.T) {
+	c, err := parseConfigString(`
+export_raw_values: true
+sensors:
+  91:
+    location: fridge
+    protocol: weather12
+    calibration:
+      temperature:
+        offset: -0.8
+      humidity:
+        points:
+          - raw: 30
+            actual: 33
+          - raw: 70
+            actual: 75
+`)
+
+	require.NoError(t, err)
+	assert.True(t, c.ExportRawValues)
+	assert.Equal(t, -0.8, c.Sensors["91"].Calibration.Temperature.Offset)
+	assert.Nil(t, c.Sensors["91"].Calibration.Temperature.Gain)
+	assert.Equal(t, []CalibrationPoint{{Raw: 30, Actual: 33}, {Raw: 70, Actual: 75}},
+		c.Sensors["91"].Calibration.Humidity.Points)
+}
+
+func TestParseConfig_invalidCalibration(t *testing.T) {
+	_, err := parseConfigString(`
+sensors:
+  91:
+    location: fridge
+    protocol: weather12
+    calibration:
+      humidity:
+        gain: 0
+`)
+
+	assert.EqualError(t, err, "sensor id 91 has invalid calibration: humidity: gain must not be 0")
+}
+
+func TestParseConfig_unknownDerivedMetric(t *testing.T) {
+	_, err := parseConfigString(`
+derived_metrics: [dew_point, dew]
+`)
+
+	assert.EqualError(t, err, `unknown derived metric "dew" `+
+		`(supported: dew_point, absolute_humidity, vapor_pressure_deficit, heat_index)`)
+}
+
+func TestParseConfig_staleTimeout(t *testing.T) {
+	c, err := parseConfigString(`
+stale_timeout: 15m
+sensors:
+  91:
+    location: fridge
+    protocol: weather12
+    stale_timeout: 5m
+  1235:
+    location: kitchen
+    protocol: weather15
+`)
+
+	require.NoError(t, err)
+	assert.Equal(t, 15*time.Minute, c.StaleTimeout)
+	assert.Equal(t, 5*time.Minute, c.Sensors["91"].StaleTimeout)
+	assert.Equal(t, 15*time.Minute, c.Sensors["1235"].StaleTimeout, "Inherits default stale timeout")
+
+	c, err = parseConfigString("")
+	require.NoError(t, err)
+	assert.Equal(t, 10*time.Minute, c.StaleTimeout, "Default stale timeout")
+}
+
+func TestParseConfig_ignore(t *testing.T) {
+	c, err := parseConfigString(`
+ignore:
+  - id: 145
+  - id: 2320
+    protocol: weather15
+    channel: 2
+`)
+
+	require.NoError(t, err)
+	assert.Equal(t, []IgnoreRule{{ID: "145"}, {ID: "2320", Protocol: "weather15", Channel: 2}}, c.Ignore)
+	assert.True(t, c.Ignored("weather12", &GTWT01Result{Name: "145"}))
+	assert.False(t, c.Ignored("weather12", &GTWT01Result{Name: "2320", Channel: 2}))
+
+	_, err = parseConfigString(`
+ignore:
+  - protocol: weather99
+`)
+	assert.EqualError(t, err, "ignore rule 1 has no id specified; "+
+		`ignore rule 1 has unknown protocol "weather99" (supported: weather12, weather15)`)
+}
+
+func TestParseConfig_metrics(t *testing.T) {
+	c, err := parseConfigString(`
+metrics:
+  namespace: home
+  humidity_unit: ratio
+  names:
+    temperature_celsius: temp_celsius
+  labels:
+    site: berlin
+sensors:
+  91:
+    location: fridge
+    protocol: weather12
+    labels:
+      floor: 1
+`)
+
+	require.NoError(t, err)
+	assert.Equal(t, "home_temp_celsius", c.Metrics.metricName("temperature_celsius"))
+	assert.Equal(t, "home_battery_low", c.Metrics.metricName("battery_low"))
+	assert.Equal(t, 0.6, c.Metrics.humidity(60))
+	assert.Equal(t, map[string]string{"site": "berlin"}, c.Metrics.Labels)
+	assert.Equal(t, map[string]string{"floor": "1"}, c.Sensors["91"].Labels)
+
+	c, err = parseConfigString("")
+	require.NoError(t, err)
+	assert.Equal(t, "meter_temperature_celsius", c.Metrics.metricName("temperature_celsius"), "Default name")
+	assert.Equal(t, 60.0, c.Metrics.humidity(60), "Default humidity unit")
+}
+
+func TestParseConfig_invalidMetrics(t *testing.T) {
+	_, err := parseConfigString(`
+metrics:
+  namespace: my-home
+  humidity_unit: permille
+  names:
+    temperature: temp
+    humidity_percent: temperature_celsius
+    battery_low: low battery
+  labels:
+    id: 1
+    __name: x
+    site: berlin
+sensors:
+  91:
+    location: fridge
+    protocol: weather12
+    labels:
+      location: kitchen
+      site: x
+`)
+
+	assert.EqualError(t, err, `metrics namespace "my-home" is invalid; `+
+		`metrics humidity unit "permille" is invalid (supported: percent, ratio); `+
+		`metrics names: metric "battery_low" has invalid name "low battery"; `+
+		`metrics names: unknown metric "temperature"; `+
+		`metrics names: metrics "temperature_celsius" and "humidity_percent" are both named "my-home_temperature_celsius"; `+
+		`metrics labels: label name "__name" is invalid; `+
+		`metrics labels: label name "id" is reserved; `+
+		`sensor id 91 has invalid labels: label name "location" is reserved; `+
+		`sensor id 91 has label site, which is already set for all metrics`)
+}
+
+func TestSanitizeName(t *testing.T) {
+	assert.Equal(t, "weather_station_pi_1_91", sanitizeName("weather station/pi.1_91"))
 }
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// closeTimeout is the time Close waits for queued readings to be written,
+// before it cancels the outputs and gives up on writes that are still retried.
+const closeTimeout = 30 * time.Second
+
+// Exporter decodes signals read from the Arduino and exports the readings
+// of configured sensors via its own Prometheus registry.
+type Exporter struct {
+	config       *Config
+	sensorLabels []string
+	registry     *prometheus.Registry
+	// runtime holds the Go and process collectors, which are
+	// exported alongside the registry, except via OTLP
+	runtime        *prometheus.Registry
+	metrics        *receiverMetrics
+	readings       *Readings
+	moldRisk       *MoldRisk
+	intervals      *IntervalTracker
+	unknownSensors *UnknownSensors
+	dispatcher     *dispatcher
+	stream         *streamHub
+	history        *History
+	store          *Store
+	textfile       string
+	device         deviceState
+	mqtt           *mqttOutput
+	influx         *influxOutput
+	graphite       *graphiteOutput
+	statsd         *statsdOutput
+	// cancel stops the outputs started by StartOutputs
+	cancel context.CancelFunc
+}
+
+// NewExporter creates an Exporter for the given config.
+func NewExporter(c *Config) (*Exporter, error) {
+	moldRisk, err := LoadMoldRisk(c.MoldRiskStateFile)
+	if err != nil {
+		return nil, err
+	}
+	readings, err := LoadReadings(c.ReadingsStateFile, c.Sensors)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Exporter{
+		config:         c,
+		sensorLabels:   c.sensorLabelNames(),
+		registry:       prometheus.NewRegistry(),
+		runtime:        prometheus.NewRegistry(),
+		readings:       readings,
+		moldRisk:       moldRisk,
+		intervals:      NewIntervalTracker(),
+		unknownSensors: NewUnknownSensors(),
+		stream:         newStreamHub(),
+		history:        NewHistory(c.History.Retention, c.History.Limit),
+	}
+
+	if c.Metrics.GoCollector {
+		e.runtime.MustRegister(prometheus.NewGoCollector())
+	}
+	if c.Metrics.ProcessCollector {
+		e.runtime.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	}
+
+	e.metrics = newReceiverMetrics(e.registry, c.Metrics, e.sensorLabels)
+	e.registry.MustRegister(newSensorCollector(e))
+
+	e.dispatcher = newDispatcher(newSinkMetrics(e.registry, c.Metrics))
+	e.dispatcher.add(prometheusSink{e}, SinkConfig{})
+	e.dispatcher.add(e.history, SinkConfig{})
+	e.dispatcher.add(e.stream, SinkConfig{})
+	if c.Store.Path != "" {
+		e.store, err = OpenStore(c.Store)
+		if err != nil {
+			return nil, err
+		}
+		e.dispatcher.add(e.store, c.Sinks[e.store.Name()])
+	}
+	if c.MQTT.Broker != "" {
+		e.mqtt = newMQTTOutput(c)
+		e.dispatcher.add(e.mqtt, c.Sinks[e.mqtt.Name()])
+	}
+	if c.InfluxDB.URL != "" {
+		e.influx = newInfluxOutput(c.InfluxDB, e.dispatcher.metrics)
+		e.dispatcher.add(e.influx, c.Sinks[e.influx.Name()])
+	}
+	if c.Graphite.Address != "" {
+		e.graphite = newGraphiteOutput(c.Graphite)
+		e.dispatcher.add(e.graphite, c.Sinks[e.graphite.Name()])
+	}
+	if c.StatsD.Address != "" {
+		e.statsd = newStatsDOutput(c.StatsD)
+		e.dispatcher.add(e.statsd, c.Sinks[e.statsd.Name()])
+	}
+
+	return e, nil
+}
+
+// StartOutputs starts writing readings to all sinks, downsamples old readings in the store,
+// connects to the configured MQTT broker, starts writing batches of readings to InfluxDB and
+// periodically rewrites the textfile and pushes the metrics to the configured Pushgateway,
+// remote-write endpoint and OTLP endpoint until ctx is done or the exporter is closed.
+func (e *Exporter) StartOutputs(ctx context.Context) error {
+	ctx, e.cancel = context.WithCancel(ctx)
+	e.dispatcher.start(ctx)
+
+	if e.textfile != "" {
+		go e.writeTextfilePeriodically(ctx, textfileInterval)
+	}
+
+	if e.store != nil {
+		log.Printf("Storing readings in '%v'", e.config.Store.Path)
+		go e.store.run(ctx)
+	}
+
+	if e.mqtt != nil {
+		go e.mqtt.connect(ctx)
+	}
+
+	if e.influx != nil {
+		log.Printf("Writing readings to InfluxDB '%v'", e.config.InfluxDB.URL)
+		go e.influx.run(ctx)
+	}
+
+	if e.config.Pushgateway.URL != "" {
+		log.Printf("Pushing metrics to '%v'", e.config.Pushgateway.URL)
+		go e.pushPeriodically(ctx)
+	}
+
+	if e.config.RemoteWrite.URL != "" {
+		w, err := newRemoteWriter(e.config.RemoteWrite, e.gatherer())
+		if err != nil {
+			return err
+		}
+		log.Printf("Writing metrics to '%v'", e.config.RemoteWrite.URL)
+		go w.run(ctx)
+	}
+	if e.config.OTLP.Endpoint != "" {
+		log.Printf("Exporting metrics via OTLP to '%v'", e.config.OTLP.Endpoint)
+		go newOTLPOutput(e.config.OTLP, e.registry, time.Now()).run(ctx)
+	}
+	return nil
+}
+
+// gatherer returns the gatherer of all metrics of the exporter.
+func (e *Exporter) gatherer() prometheus.Gatherer {
+	return prometheus.Gatherers{e.registry, e.runtime}
+}
+
+// Close marks the exporter as unavailable, e.g. when the Arduino has been disconnected,
+// writes all readings that are still queued, batched or not yet saved and stops the outputs.
+// The store stays open, so that its history can still be queried.
+func (e *Exporter) Close() {
+	e.close(closeTimeout)
+}
+
+// close is Close, giving up on queued readings that have not been written within timeout.
+func (e *Exporter) close(timeout time.Duration) {
+	e.device.set("", false, time.Now())
+
+	drained := make(chan struct{})
+	go func() {
+		e.dispatcher.close()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(timeout):
+		log.Printf("Queued readings have not been written within %v, giving up", timeout)
+	}
+	if e.cancel != nil {
+		e.cancel()
+	}
+	<-drained
+
+	if err := e.readings.Flush(); err != nil {
+		log.Println(err)
+	}
+	if err := e.moldRisk.Flush(); err != nil {
+		log.Println(err)
+	}
+	if e.mqtt != nil {
+		e.mqtt.close()
+	}
+	if e.influx != nil {
+		e.influx.flush()
+	}
+	if e.graphite != nil {
+		e.graphite.close()
+	}
+}
+
+// Handler serves the metrics and the API of the exporter.
+func (e *Exporter) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", e.statusPageHandler)
+	mux.Handle("/metrics", promhttp.HandlerFor(e.gatherer(), promhttp.HandlerOpts{}))
+	mux.HandleFunc("/api/ventilation", e.ventilationHandler)
+	mux.HandleFunc("/api/unknown-sensors", e.unknownSensorsHandler)
+	mux.HandleFunc("/api/sensors", e.sensorsHandler)
+	mux.HandleFunc("/api/sensors/", e.sensorHandler)
+	mux.HandleFunc("/api/stream", e.streamHandler)
+	mux.HandleFunc("/api/history", e.historyHandler)
+	mux.HandleFunc("/api/openapi.json", openAPIHandler)
+	return mux
+}
+
+// DecodedSignal decodes a compressed signal read from the Arduino
+// by trying all currently supported protocols and stores result for Prometheus scraping
+func (e *Exporter) DecodedSignal(line string) (stop bool) {
+	stop = false
+
+	e.metrics.linesRead.Inc()
+
+	if strings.HasPrefix(line, ReceivePrefix) {
+		e.metrics.signalsReceived.Inc()
+		start := time.Now()
+		trimmed := strings.TrimPrefix(line, ReceivePrefix)
+		e.stream.signal(trimmed, start)
+
+		pulse, err := PreparePulse(trimmed)
+		if err != nil {
+			e.metrics.prepareErrors.Inc()
+			log.Println(err)
+			return
+		}
+
+		matchingProtocols := MatchingProtocols(pulse)
+		for _, p := range matchingProtocols {
+			e.metrics.protocolMatches.WithLabelValues(p).Inc()
+		}
+
+		decoded := decodeMatchingProtocols(matchingProtocols, pulse)
+		if !e.processedWithMatchingConfig(decoded) && !e.ignored(decoded) {
+			if len(decoded) == 0 {
+				e.metrics.decodeFailures.Inc()
+			} else {
+				e.metrics.unconfiguredSignals.Inc()
+			}
+			e.printAllMatchingProtocols(matchingProtocols, decoded)
+		}
+
+		e.metrics.decodeDuration.Observe(time.Since(start).Seconds())
+	}
+	return
+}
+
+// decodeMatchingProtocols decodes a pulse with each of the matching protocols,
+// leaving out the protocols it could not be decoded with.
+func decodeMatchingProtocols(matchingProtocols []string, pulse *Signal) map[string]*GTWT01Result {
+	decoded := map[string]*GTWT01Result{}
+	for _, p := range matchingProtocols {
+		result, err := DecodePulse(pulse, p)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		decoded[p] = result.(*GTWT01Result)
+	}
+	return decoded
+}
+
+// ignored checks whether any decoding of a signal belongs to an ignored sensor,
+// in which case decodings with other protocols are meaningless.
+func (e *Exporter) ignored(decoded map[string]*GTWT01Result) bool {
+	for p, m := range decoded {
+		if e.config.Ignored(p, m) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *Exporter) printAllMatchingProtocols(matchingProtocols []string, decoded map[string]*GTWT01Result) {
+
+	firstMatch := true
+	for _, p := range matchingProtocols {
+		m, ok := decoded[p]
+		if !ok {
+			continue
+		}
+		e.stream.unknownSensor(e.unknownSensors.Add(p, m, time.Now()))
+		if firstMatch {
+			log.Println("Sensor has no matching configuration, potential protocols:")
+			firstMatch = false
+		}
+		log.Printf("%v: %+v\n", p, *m)
+	}
+	if firstMatch {
+		log.Println("Unsupported protocol or error decoding the pulse")
+	} else {
+		log.Println("Add to configuration with appropriate protocol")
+	}
+}
+
+// processedWithMatchingConfig handles the reading of the configured sensor
+// whose protocol and id match one of the decodings of a signal, if any.
+func (e *Exporter) processedWithMatchingConfig(decoded map[string]*GTWT01Result) bool {
+	for id, sensor := range e.config.Sensors {
+		m, ok := decoded[sensor.Protocol]
+		if ok && m.Name == id {
+			e.handleReading(NewReading(sensor, m, time.Now()))
+			log.Printf("%v: %+v\n", sensor.Location, *m)
+			return true
+		}
+	}
+	return false
+}
+
+// handleReading sends a reading of a configured sensor to all sinks, the first
+// of which stores it for Prometheus scraping.
+func (e *Exporter) handleReading(r *Reading) {
+	e.dispatcher.dispatch(r)
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrintAllMatchingProtocols(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() {
+		log.SetOutput(os.Stderr)
+	}()
+
+	s := &Signal{
+		Lengths: []int{516, 2116, 4152, 9112},
+		Seq:     "0102020101020201020101020102010202020202020202010201010202010202020202020103",
+	}
+
+	e := newTestExporter(t, loadSampleConfig())
+	protocols := []string{"weather12", "weather15"}
+	e.printAllMatchingProtocols(protocols, decodeMatchingProtocols(protocols, s))
+	assert.Contains(t, buf.String(), "weather12")
+	assert.Contains(t, buf.String(), "weather15")
+	assert.Len(t, e.unknownSensors.All(), 2)
+}
+
+func TestExporter_ignored(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() {
+		log.SetOutput(os.Stderr)
+	}()
+
+	s := &Signal{
+		Lengths: []int{516, 2116, 4152, 9112},
+		Seq:     "0102020101020201020101020102010202020202020202010201010202010202020202020103",
+	}
+
+	c, err := parseConfigString(`
+ignore:
+  - id: 1641
+    protocol: weather15
+`)
+	require.NoError(t, err)
+	e := newTestExporter(t, c)
+
+	protocols := []string{"weather12", "weather15"}
+	assert.True(t, e.ignored(decodeMatchingProtocols(protocols, s)))
+}
+
+func TestDecodedSignal_ignored(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() {
+		log.SetOutput(os.Stderr)
+	}()
+
+	c, err := parseConfigString(`
+ignore:
+  - id: 2320
+    protocol: weather15
+`)
+	require.NoError(t, err)
+	e := newTestExporter(t, c)
+
+	e.DecodedSignal("RF receive 560 4112 2068 9080 0 0 0 0 " +
+		"0102020102020201020202020102020102020202010102020201020202020101020101020103")
+
+	assert.NotContains(t, buf.String(), "Sensor has no matching configuration")
+	assert.Empty(t, e.unknownSensors.All())
+	assert.Contains(t, gatherText(t, e, "meter_receiver_unconfigured_signals_total"),
+		"meter_receiver_unconfigured_signals_total 0")
+}
+
+func TestProcessedWithMatchingConfigNoMatch(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() {
+		log.SetOutput(os.Stderr)
+	}()
+
+	s := &Signal{
+		Lengths: []int{516, 2116, 4152, 9112},
+		Seq:     "0102020101020201020101020102010202020202020202010201010202010202020202020103",
+	}
+
+	e := newTestExporter(t, loadSampleConfig())
+	processed := e.processedWithMatchingConfig(decodeMatchingProtocols([]string{"weather12", "weather15"}, s))
+	assert.False(t, processed)
+}
+
+func TestProcessedWithMatchingConfigMatch(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() {
+		log.SetOutput(os.Stderr)
+	}()
+
+	s := &Signal{
+		Lengths: []int{616, 1996, 4048, 9044},
+		Seq:     "0102010202010202010101010101010102010202020102020102020102010202020102020103",
+	}
+
+	e := newTestExporter(t, loadSampleConfig())
+	processed := e.processedWithMatchingConfig(decodeMatchingProtocols([]string{"weather12", "weather15"}, s))
+	assert.True(t, processed)
+	assert.Contains(t, buf.String(), "fridge: {ID:91 Name:91 Channel:1 Temperature:18.7 Humidity:53 LowBattery:false}")
+
+	r := e.readings.Get("91")
+	require.NotNil(t, r)
+	assert.Equal(t, 18.7, r.Temperature)
+	assert.Equal(t, 53.0, r.Humidity)
+}
+
+func TestDecodedSignal_receiverMetrics(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() {
+		log.SetOutput(os.Stderr)
+	}()
+
+	e := newTestExporter(t, loadSampleConfig())
+
+	e.DecodedSignal("ACK")
+	e.DecodedSignal("RF receive 1008 576")
+	e.DecodedSignal("RF receive 1008 576 7880 4064 1856 16004 0 0 " +
+		"00000000121313141313131413141413141414141414131413141313141314141314131314131414141414141315")
+	e.DecodedSignal("RF receive 560 4112 2068 9080 0 0 0 0 " +
+		"0102020102020201020202020102020102020202010102020201020202020101020101020103")
+	e.DecodedSignal("RF receive 616 1996 4048 9044 0 0 0 0 " +
+		"0102010202010202010101010101010102010202020102020102020102010202020102020103")
+
+	assert.Equal(t, `# HELP meter_receiver_decode_errors_total Number of received signals that could not be decoded with any protocol
+# TYPE meter_receiver_decode_errors_total counter
+meter_receiver_decode_errors_total 1
+# HELP meter_receiver_lines_read_total Number of lines read from the Arduino
+# TYPE meter_receiver_lines_read_total counter
+meter_receiver_lines_read_total 5
+# HELP meter_receiver_prepare_errors_total Number of received signals that could not be prepared for decoding
+# TYPE meter_receiver_prepare_errors_total counter
+meter_receiver_prepare_errors_total 1
+# HELP meter_receiver_protocol_matches_total Number of received signals matching a protocol
+# TYPE meter_receiver_protocol_matches_total counter
+meter_receiver_protocol_matches_total{protocol="weather12"} 2
+meter_receiver_protocol_matches_total{protocol="weather15"} 2
+# HELP meter_receiver_signals_received_total Number of signals received via RF
+# TYPE meter_receiver_signals_received_total counter
+meter_receiver_signals_received_total 4
+# HELP meter_receiver_unconfigured_signals_total Number of decoded signals of sensors that are not configured
+# TYPE meter_receiver_unconfigured_signals_total counter
+meter_receiver_unconfigured_signals_total 1
+`, gatherText(t, e, "meter_receiver_decode_errors_total",
+		"meter_receiver_lines_read_total",
+		"meter_receiver_prepare_errors_total",
+		"meter_receiver_protocol_matches_total",
+		"meter_receiver_signals_received_total",
+		"meter_receiver_unconfigured_signals_total"))
+
+	families, err := e.registry.Gather()
+	require.NoError(t, err)
+	for _, f := range families {
+		if f.GetName() == "meter_receiver_decode_duration_seconds" {
+			assert.Equal(t, uint64(3), f.GetMetric()[0].GetHistogram().GetSampleCount(),
+				"Decode duration of prepared signals is observed")
+		}
+	}
+}
+
+func TestDecodedSignal_countsSignalsOnce(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() {
+		log.SetOutput(os.Stderr)
+	}()
+
+	c, err := parseConfigString(`
+sensors:
+  91:
+    location: fridge
+    protocol: weather12
+  92:
+    location: garden
+    protocol: weather12
+  2321:
+    location: kitchen
+    protocol: weather15
+`)
+	require.NoError(t, err)
+	e := newTestExporter(t, c)
+
+	e.DecodedSignal("RF receive 560 4112 2068 9080 0 0 0 0 " +
+		"0102020102020201020202020102020102020202010102020201020202020101020101020103")
+
+	assert.Equal(t, `# HELP meter_receiver_decode_errors_total Number of received signals that could not be decoded with any protocol
+# TYPE meter_receiver_decode_errors_total counter
+meter_receiver_decode_errors_total 0
+# HELP meter_receiver_unconfigured_signals_total Number of decoded signals of sensors that are not configured
+# TYPE meter_receiver_unconfigured_signals_total counter
+meter_receiver_unconfigured_signals_total 1
+`, gatherText(t, e, "meter_receiver_decode_errors_total", "meter_receiver_unconfigured_signals_total"),
+		"A signal is counted once, however many sensors use its protocols")
+}
+
+func TestCollect(t *testing.T) {
+	c, err := parseConfigString(`
+export_raw_values: true
+derived_metrics: [dew_point]
+sensors:
+  91:
+    location: fridge
+    protocol: weather12
+    calibration:
+      temperature:
+        offset: -0.5
+    mold_risk: true
+  1235:
+    location: kitchen
+    protocol: weather15
+`)
+	require.NoError(t, err)
+	e := newTestExporter(t, c)
+
+	now := time.Now()
+	e.handleReading(NewReading(c.Sensors["91"],
+		&GTWT01Result{ID: 91, Name: "91", Channel: 1, Temperature: 20.5, Humidity: 60, LowBattery: true}, now))
+	e.unknownSensors.Add("weather15", &GTWT01Result{ID: 2320, Name: "2320", Channel: 2}, now)
+
+	assert.Equal(t, `# HELP meter_battery_low Whether the battery of the sensor is low (1) or not (0)
+# TYPE meter_battery_low gauge
+meter_battery_low{id="91",location="fridge"} 1
+# HELP meter_dew_point_celsius Current dew point in Celsius
+# TYPE meter_dew_point_celsius gauge
+meter_dew_point_celsius{id="91",location="fridge"} 11.995453892411351
+# HELP meter_humidity_percent Current humidity level in %
+# TYPE meter_humidity_percent gauge
+meter_humidity_percent{id="91",location="fridge"} 60
+# HELP meter_humidity_raw_percent Current humidity level in % as measured by the sensor (i.e. without calibration)
+# TYPE meter_humidity_raw_percent gauge
+meter_humidity_raw_percent{id="91",location="fridge"} 60
+# HELP meter_mold_index Current mold index from 0 (no growth) to 6 (heavy growth)
+# TYPE meter_mold_index gauge
+meter_mold_index{id="91",location="fridge"} 0
+# HELP meter_sensor_info Information about the sensor, always 1
+# TYPE meter_sensor_info gauge
+meter_sensor_info{channel="1",id="91",location="fridge",protocol="weather12"} 1
+# HELP meter_temperature_celsius Current temperature in Celsius
+# TYPE meter_temperature_celsius gauge
+meter_temperature_celsius{id="91",location="fridge"} 20
+# HELP meter_temperature_raw_celsius Current temperature in Celsius as measured by the sensor (i.e. without calibration)
+# TYPE meter_temperature_raw_celsius gauge
+meter_temperature_raw_celsius{id="91",location="fridge"} 20.5
+# HELP meter_unknown_sensor_info Sensor that has been received, but is not configured, always 1
+# TYPE meter_unknown_sensor_info gauge
+meter_unknown_sensor_info{channel="2",id="2320",protocol="weather15"} 1
+`, gatherText(t, e, "meter_battery_low",
+		"meter_dew_point_celsius",
+		"meter_heat_index_celsius",
+		"meter_humidity_percent",
+		"meter_humidity_raw_percent",
+		"meter_mold_index",
+		"meter_sensor_info",
+		"meter_temperature_celsius",
+		"meter_temperature_raw_celsius",
+		"meter_unknown_sensor_info"))
+}
+
+func TestCollect_customNamesAndLabels(t *testing.T) {
+	c, err := parseConfigString(`
+metrics:
+  namespace: home
+  humidity_unit: ratio
+  names:
+    temperature_celsius: temp_celsius
+  labels:
+    site: berlin
+sensors:
+  91:
+    location: fridge
+    protocol: weather12
+    labels:
+      floor: 1
+  1235:
+    location: kitchen
+    protocol: weather15
+`)
+	require.NoError(t, err)
+	e := newTestExporter(t, c)
+
+	now := time.Now()
+	e.handleReading(NewReading(c.Sensors["91"], &GTWT01Result{Channel: 1, Temperature: 4.2, Humidity: 60}, now))
+	e.handleReading(NewReading(c.Sensors["1235"], &GTWT01Result{Channel: 2, Temperature: 21, Humidity: 45}, now))
+	e.DecodedSignal("ACK")
+
+	assert.Equal(t, `# HELP home_humidity_ratio Current humidity level as ratio from 0 to 1
+# TYPE home_humidity_ratio gauge
+home_humidity_ratio{floor="",id="1235",location="kitchen",site="berlin"} 0.45
+home_humidity_ratio{floor="1",id="91",location="fridge",site="berlin"} 0.6
+# HELP home_receiver_lines_read_total Number of lines read from the Arduino
+# TYPE home_receiver_lines_read_total counter
+home_receiver_lines_read_total{site="berlin"} 1
+# HELP home_sensor_info Information about the sensor, always 1
+# TYPE home_sensor_info gauge
+home_sensor_info{channel="1",floor="1",id="91",location="fridge",protocol="weather12",site="berlin"} 1
+home_sensor_info{channel="2",floor="",id="1235",location="kitchen",protocol="weather15",site="berlin"} 1
+# HELP home_temp_celsius Current temperature in Celsius
+# TYPE home_temp_celsius gauge
+home_temp_celsius{floor="",id="1235",location="kitchen",site="berlin"} 21
+home_temp_celsius{floor="1",id="91",location="fridge",site="berlin"} 4.2
+`, gatherText(t, e, "home_humidity_ratio",
+		"home_receiver_lines_read_total",
+		"home_sensor_info",
+		"home_temp_celsius"))
+}
+
+func TestCollect_staleSensor(t *testing.T) {
+	c := loadSampleConfig()
+	e := newTestExporter(t, c)
+
+	e.handleReading(NewReading(c.Sensors["91"], &GTWT01Result{Channel: 1, Temperature: 4.2, Humidity: 60}, testTime))
+
+	assert.Equal(t, `# HELP meter_last_seen_timestamp_seconds Time when a signal of the sensor has been received last, in seconds since epoch
+# TYPE meter_last_seen_timestamp_seconds gauge
+meter_last_seen_timestamp_seconds{id="91",location="fridge"} 1.570397368e+09
+# HELP meter_sensor_info Information about the sensor, always 1
+# TYPE meter_sensor_info gauge
+meter_sensor_info{channel="1",id="91",location="fridge",protocol="weather12"} 1
+`, gatherText(t, e, "meter_humidity_percent",
+		"meter_last_seen_timestamp_seconds",
+		"meter_sensor_info",
+		"meter_temperature_celsius"), "Only last seen and info of stale sensors are collected")
+}
+
+func TestCollect_timestamps(t *testing.T) {
+	c := loadSampleConfig()
+	c.Metrics.Timestamps = true
+	e := newTestExporter(t, c)
+
+	now := time.Now().Truncate(time.Millisecond)
+	e.handleReading(NewReading(c.Sensors["91"], &GTWT01Result{Temperature: 4.2, Humidity: 60}, now))
+
+	families, err := e.registry.Gather()
+	require.NoError(t, err)
+	for _, f := range families {
+		if f.GetName() == "meter_temperature_celsius" {
+			assert.Equal(t, now.UnixNano()/int64(time.Millisecond), f.GetMetric()[0].GetTimestampMs())
+		}
+		if f.GetName() == "meter_last_seen_timestamp_seconds" {
+			assert.Nil(t, f.GetMetric()[0].TimestampMs, "Last seen is always current")
+		}
+	}
+}
+
+func TestNewExporter_collectors(t *testing.T) {
+	c := loadSampleConfig()
+	assert.True(t, c.Metrics.GoCollector, "Go collector is enabled by default")
+	assert.True(t, c.Metrics.ProcessCollector, "Process collector is enabled by default")
+
+	body := scrape(t, newTestExporter(t, c))
+	assert.Contains(t, body, "go_goroutines")
+
+	c.Metrics.GoCollector = false
+	c.Metrics.ProcessCollector = false
+	body = scrape(t, newTestExporter(t, c))
+	assert.NotContains(t, body, "go_goroutines")
+	assert.NotContains(t, body, "process_")
+	assert.Contains(t, body, "meter_receiver_lines_read_total 0")
+}
+
+func TestNewExporter_restoresReadings(t *testing.T) {
+	AppFs = afero.NewMemMapFs()
+	c := loadSampleConfig()
+	c.ReadingsStateFile = "/var/lib/readings.json"
+	lastMinute := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339Nano)
+	afero.WriteFile(AppFs, c.ReadingsStateFile, []byte(`{
+		"91": {"time": "`+lastMinute+`", "channel": 1, "temperature": 4.2, "humidity": 60},
+		"1235": {"time": "2019-10-06T21:29:28Z", "temperature": 21, "humidity": 45}
+	}`), 0644)
+
+	e := newTestExporter(t, c)
+
+	assert.Equal(t, `# HELP meter_temperature_celsius Current temperature in Celsius
+# TYPE meter_temperature_celsius gauge
+meter_temperature_celsius{id="91",location="fridge"} 4.2
+`, gatherText(t, e, "meter_temperature_celsius"), "Restored readings keep their time and become stale")
+	assert.Contains(t, gatherText(t, e, "meter_last_seen_timestamp_seconds"),
+		`meter_last_seen_timestamp_seconds{id="1235",location="kitchen"} 1.570397368e+09`)
+}
+
+func TestExporter_close_givesUpOnRetries(t *testing.T) {
+	e := newTestExporter(t, loadSampleConfig())
+	s := &fakeSink{errs: []error{errors.New("unavailable"), errors.New("unavailable")}}
+	e.dispatcher.add(s, SinkConfig{QueueSize: 10, Retries: 2, Backoff: time.Hour})
+	require.NoError(t, e.StartOutputs(context.Background()))
+	e.dispatcher.dispatch(testReading(4.2))
+
+	closed := make(chan struct{})
+	go func() {
+		e.close(10 * time.Millisecond)
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close still waiting for the retry of a queued reading")
+	}
+	assert.Empty(t, s.temperatures())
+}
+
+func newTestExporter(t *testing.T, c *Config) *Exporter {
+	e, err := NewExporter(c)
+	require.NoError(t, err)
+	return e
+}
+
+// scrape returns the metrics served by the exporter.
+func scrape(t *testing.T, e *Exporter) string {
+	s := httptest.NewServer(e.Handler())
+	defer s.Close()
+
+	resp, err := s.Client().Get(s.URL + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+var testTime = time.Date(2019, 10, 6, 21, 29, 28, 0, time.UTC)
+
+// gatherText returns the named metrics of the exporter's registry in the text format.
+func gatherText(t *testing.T, e *Exporter, names ...string) string {
+	families, err := e.registry.Gather()
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	for _, f := range families {
+		for _, name := range names {
+			if f.GetName() == name {
+				_, err := expfmt.MetricFamilyToText(&buf, f)
+				require.NoError(t, err)
+			}
+		}
+	}
+	return buf.String()
+}
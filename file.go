@@ -0,0 +1,35 @@
+package main
+
+import (
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+// writeFileAtomic writes data to a temporary file first, which
+// then replaces the named file, so that it is never partially written.
+func writeFileAtomic(name string, data []byte) error {
+	tmp, err := afero.TempFile(AppFs, filepath.Dir(name), "."+filepath.Base(name))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write '%s'", name)
+	}
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// temporary files are only readable by their owner, but e.g.
+		// node_exporter usually runs as a different user
+		err = AppFs.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = AppFs.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		AppFs.Remove(tmp.Name())
+		return errors.Wrapf(err, "Failed to write '%s'", name)
+	}
+	return nil
+}
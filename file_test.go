@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	AppFs = afero.NewMemMapFs()
+	afero.WriteFile(AppFs, "/var/lib/state.json", []byte("old"), 0644)
+
+	require.NoError(t, writeFileAtomic("/var/lib/state.json", []byte("new")))
+
+	data, err := afero.ReadFile(AppFs, "/var/lib/state.json")
+	require.NoError(t, err)
+	assert.Equal(t, "new", string(data), "Existing file is replaced")
+	files, _ := afero.ReadDir(AppFs, "/var/lib")
+	assert.Len(t, files, 1, "No temporary files are left behind")
+}
+
+func TestWriteFileAtomic_readableByOthers(t *testing.T) {
+	AppFs = afero.NewOsFs()
+	dir, err := afero.TempDir(AppFs, "", "weather-station")
+	require.NoError(t, err)
+	defer AppFs.RemoveAll(dir)
+
+	require.NoError(t, writeFileAtomic(filepath.Join(dir, "state.json"), []byte("{}")))
+
+	info, err := AppFs.Stat(filepath.Join(dir, "state.json"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+}
+
+func TestWriteFileAtomic_missingDirectory(t *testing.T) {
+	AppFs = afero.NewOsFs()
+	dir, err := afero.TempDir(AppFs, "", "weather-station")
+	require.NoError(t, err)
+	defer AppFs.RemoveAll(dir)
+
+	err = writeFileAtomic(filepath.Join(dir, "missing", "state.json"), []byte("{}"))
+
+	assert.Error(t, err)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// GraphiteConfig configures sending readings to Graphite via the plaintext protocol.
+type GraphiteConfig struct {
+	// Address is the host:port of Carbon's plaintext listener (sending is disabled if not set)
+	Address string `mapstructure:"address"`
+	// PathTemplate is the path of the metrics, e.g. weather.{location}.{quantity}
+	PathTemplate pathTemplate  `mapstructure:"path_template"`
+	Timeout      time.Duration `mapstructure:"timeout"`
+}
+
+func (g GraphiteConfig) validate() ValidationErrors {
+	var errs ValidationErrors
+	if g.Address == "" {
+		return errs
+	}
+
+	if _, _, err := net.SplitHostPort(g.Address); err != nil {
+		errs = append(errs, fmt.Errorf("graphite: invalid address %q", g.Address))
+	}
+	if err := g.PathTemplate.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("graphite: %v", err))
+	}
+	if g.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("graphite: timeout must be positive, got %v", g.Timeout))
+	}
+	return errs
+}
+
+// pathTemplate is a dot-separated metric path, whose placeholders
+// are replaced with the (sanitized) values of a reading.
+type pathTemplate string
+
+var pathPlaceholders = []string{"{id}", "{location}", "{protocol}", "{quantity}"}
+
+func (p pathTemplate) validate() error {
+	if p == "" {
+		return fmt.Errorf("path template must not be empty")
+	}
+
+	rest := string(p)
+	for _, placeholder := range pathPlaceholders {
+		rest = strings.Replace(rest, placeholder, "", -1)
+	}
+	if strings.ContainsAny(rest, "{} ") {
+		return fmt.Errorf("path template %q is invalid (supported placeholders: %s)",
+			p, strings.Join(pathPlaceholders, ", "))
+	}
+	return nil
+}
+
+// path returns the path of a quantity of a sensor.
+func (p pathTemplate) path(s *SensorConfig, quantity string) string {
+	return strings.NewReplacer(
+		"{id}", sanitizeName(s.ID),
+		"{location}", sanitizeName(s.Location),
+		"{protocol}", sanitizeName(s.Protocol),
+		"{quantity}", sanitizeName(quantity),
+	).Replace(string(p))
+}
+
+type quantity struct {
+	name  string
+	value float64
+}
+
+// quantities returns the values of a reading sent to outputs without
+// labels or tags, with low battery being 1 and 0 otherwise.
+func quantities(r *Reading) []quantity {
+	return []quantity{
+		{"temperature", r.Temperature},
+		{"humidity", r.Humidity},
+		{"low_battery", boolToFloat(r.LowBattery)},
+	}
+}
+
+// graphiteOutput sends readings over a persistent TCP connection,
+// which is reestablished if it has been closed.
+type graphiteOutput struct {
+	sync.Mutex
+	config GraphiteConfig
+	conn   net.Conn
+}
+
+func newGraphiteOutput(c GraphiteConfig) *graphiteOutput {
+	return &graphiteOutput{config: c}
+}
+
+// Name identifies the Graphite output as sink.
+func (o *graphiteOutput) Name() string {
+	return "graphite"
+}
+
+// Write sends the quantities of a reading with the time it has been received.
+func (o *graphiteOutput) Write(r *Reading) error {
+	var b bytes.Buffer
+	for _, q := range quantities(r) {
+		fmt.Fprintf(&b, "%s %s %d\n", o.config.PathTemplate.path(r.Sensor, q.name), formatFloat(q.value), r.Time.Unix())
+	}
+
+	return o.write(b.Bytes())
+}
+
+func (o *graphiteOutput) write(data []byte) error {
+	o.Lock()
+	defer o.Unlock()
+
+	var err error
+	// a failed write is repeated once on a new connection,
+	// as Carbon might have closed the previous one
+	for attempt := 0; attempt < 2; attempt++ {
+		if o.conn == nil {
+			o.conn, err = net.DialTimeout("tcp", o.config.Address, o.config.Timeout)
+			if err != nil {
+				o.conn = nil
+				return errors.Wrapf(err, "Failed to send to Graphite '%s'", o.config.Address)
+			}
+		}
+
+		o.conn.SetWriteDeadline(time.Now().Add(o.config.Timeout))
+		if _, err = o.conn.Write(data); err == nil {
+			return nil
+		}
+		o.conn.Close()
+		o.conn = nil
+	}
+	return errors.Wrapf(err, "Failed to send to Graphite '%s'", o.config.Address)
+}
+
+func (o *graphiteOutput) close() {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.conn != nil {
+		o.conn.Close()
+		o.conn = nil
+	}
+}
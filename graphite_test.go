@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPathTemplate(t *testing.T) {
+	s := &SensorConfig{ID: "91", Location: "living room.1", Protocol: "weather12"}
+
+	assert.Equal(t, "weather.living_room_1.temperature",
+		pathTemplate("weather.{location}.{quantity}").path(s, "temperature"))
+	assert.Equal(t, "home.weather12.91.humidity",
+		pathTemplate("home.{protocol}.{id}.{quantity}").path(s, "humidity"))
+
+	assert.NoError(t, pathTemplate("weather.{id}.{quantity}").validate())
+	assert.EqualError(t, pathTemplate("weather.{room}.{quantity}").validate(),
+		`path template "weather.{room}.{quantity}" is invalid `+
+			"(supported placeholders: {id}, {location}, {protocol}, {quantity})")
+}
+
+func TestGraphiteOutput(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	lines := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				lines <- scanner.Text()
+			}
+		}
+	}()
+
+	o := newGraphiteOutput(GraphiteConfig{
+		Address:      l.Addr().String(),
+		PathTemplate: "weather.{location}.{quantity}",
+		Timeout:      time.Second,
+	})
+	defer o.close()
+
+	require.NoError(t, o.Write(testReading(-4.2)))
+
+	for _, expected := range []string{
+		"weather.fridge.temperature -4.2 1570397368",
+		"weather.fridge.humidity 60 1570397368",
+		"weather.fridge.low_battery 0 1570397368",
+	} {
+		select {
+		case line := <-lines:
+			assert.Equal(t, expected, line)
+		case <-time.After(time.Second):
+			t.Fatalf("Expected line '%s'", expected)
+		}
+	}
+}
+
+func TestGraphiteOutput_reconnects(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	o := newGraphiteOutput(GraphiteConfig{
+		Address:      l.Addr().String(),
+		PathTemplate: "weather.{location}.{quantity}",
+		Timeout:      time.Second,
+	})
+	defer o.close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	require.NoError(t, o.write([]byte("weather.fridge.temperature 4.2 1570397368\n")))
+	(<-accepted).Close()
+
+	// the first write after the connection has been closed by the server might still succeed
+	for i := 0; i < 3; i++ {
+		if err := o.write([]byte("weather.fridge.temperature 4.3 1570397428\n")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case <-accepted:
+	case <-time.After(time.Second):
+		t.Fatal("Expected a new connection")
+	}
+}
+
+func TestParseConfig_invalidGraphite(t *testing.T) {
+	_, err := parseConfigString(`
+graphite:
+  address: graphite
+  path_template: weather.{room}
+statsd:
+  address: localhost:8125
+  path_template: ""
+`)
+
+	assert.EqualError(t, err, `graphite: invalid address "graphite"; `+
+		`graphite: path template "weather.{room}" is invalid `+
+		"(supported placeholders: {id}, {location}, {protocol}, {quantity}); "+
+		"statsd: path template must not be empty")
+}
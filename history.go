@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// HistoryConfig configures the readings kept in memory.
+type HistoryConfig struct {
+	// Retention is the time readings are kept
+	Retention time.Duration `mapstructure:"retention"`
+	// Limit is the maximum number of readings kept per sensor
+	Limit int `mapstructure:"limit"`
+}
+
+func (h HistoryConfig) validate() ValidationErrors {
+	var errs ValidationErrors
+	if h.Retention <= 0 {
+		errs = append(errs, fmt.Errorf("history: retention must be positive, got %v", h.Retention))
+	}
+	if h.Limit <= 0 {
+		errs = append(errs, fmt.Errorf("history: limit must be positive, got %d", h.Limit))
+	}
+	return errs
+}
+
+// HistoryPoint is a reading of a sensor kept in the history.
+type HistoryPoint struct {
+	Time        time.Time `json:"time"`
+	Temperature float64   `json:"temperature"`
+	Humidity    float64   `json:"humidity"`
+}
+
+// HistoryBucket aggregates the readings of a sensor within a step from Time on.
+type HistoryBucket struct {
+	Time        time.Time        `json:"time"`
+	Count       int              `json:"count"`
+	Temperature HistoryAggregate `json:"temperature"`
+	Humidity    HistoryAggregate `json:"humidity"`
+}
+
+// HistoryAggregate is the minimum, maximum and average of a value within a bucket.
+type HistoryAggregate struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+	Avg float64 `json:"avg"`
+}
+
+// History keeps the recent readings of each sensor in memory in a ring buffer
+// per sensor and is safe for concurrent use. It is a sink, so that it
+// receives every reading.
+type History struct {
+	sync.RWMutex
+	window  time.Duration
+	limit   int
+	sensors map[string]*historyRing
+}
+
+// historyRing holds the readings of a sensor, oldest first from start on.
+type historyRing struct {
+	points []HistoryPoint
+	start  int
+	n      int
+}
+
+// NewHistory creates a history keeping readings for the given time,
+// but at most limit readings per sensor.
+func NewHistory(window time.Duration, limit int) *History {
+	return &History{
+		window:  window,
+		limit:   limit,
+		sensors: map[string]*historyRing{},
+	}
+}
+
+// Name identifies the history as sink.
+func (h *History) Name() string {
+	return "history"
+}
+
+// Write adds a reading, dropping the oldest one of the sensor if the limit is reached.
+func (h *History) Write(r *Reading) error {
+	h.Lock()
+	defer h.Unlock()
+
+	ring, ok := h.sensors[r.Sensor.ID]
+	if !ok {
+		ring = &historyRing{points: make([]HistoryPoint, h.limit)}
+		h.sensors[r.Sensor.ID] = ring
+	}
+	ring.add(HistoryPoint{Time: r.Time, Temperature: r.Temperature, Humidity: r.Humidity})
+	ring.expire(r.Time.Add(-h.window))
+	return nil
+}
+
+// Get returns the readings of a sensor between from and to (both inclusive), oldest first.
+func (h *History) Get(id string, from, to time.Time) []HistoryPoint {
+	h.RLock()
+	defer h.RUnlock()
+
+	ring, ok := h.sensors[id]
+	if !ok {
+		return nil
+	}
+
+	var points []HistoryPoint
+	for i := 0; i < ring.n; i++ {
+		p := ring.points[(ring.start+i)%len(ring.points)]
+		if !p.Time.Before(from) && !p.Time.After(to) {
+			points = append(points, p)
+		}
+	}
+	return points
+}
+
+func (r *historyRing) add(p HistoryPoint) {
+	if r.n < len(r.points) {
+		r.points[(r.start+r.n)%len(r.points)] = p
+		r.n++
+		return
+	}
+	r.points[r.start] = p
+	r.start = (r.start + 1) % len(r.points)
+}
+
+// expire drops the readings before the given time.
+func (r *historyRing) expire(before time.Time) {
+	for r.n > 0 && r.points[r.start].Time.Before(before) {
+		r.start = (r.start + 1) % len(r.points)
+		r.n--
+	}
+}
+
+// downsample aggregates points, oldest first, into buckets of the given step
+// aligned to from. Buckets without readings are left out.
+func downsample(points []HistoryPoint, from time.Time, step time.Duration) []HistoryBucket {
+	buckets := make([]HistoryBucket, len(points))
+	for i, p := range points {
+		buckets[i] = p.bucket()
+	}
+	return mergeBuckets(buckets, from, step)
+}
+
+// mergeBuckets aggregates buckets, oldest first, into buckets of the given step aligned to from,
+// which must not be shorter than the step of the given buckets.
+func mergeBuckets(buckets []HistoryBucket, from time.Time, step time.Duration) []HistoryBucket {
+	merged := []HistoryBucket{}
+	for _, b := range buckets {
+		start := from.Add(b.Time.Sub(from) / step * step)
+		if len(merged) == 0 || !start.Equal(merged[len(merged)-1].Time) {
+			merged = append(merged, HistoryBucket{Time: start})
+		}
+		merged[len(merged)-1].merge(b)
+	}
+	return merged
+}
+
+// merge adds the readings aggregated in o to the bucket.
+func (b *HistoryBucket) merge(o HistoryBucket) {
+	if b.Count == 0 {
+		b.Temperature, b.Humidity, b.Count = o.Temperature, o.Humidity, o.Count
+		return
+	}
+	count := b.Count + o.Count
+	b.Temperature = b.Temperature.merge(o.Temperature, b.Count, o.Count)
+	b.Humidity = b.Humidity.merge(o.Humidity, b.Count, o.Count)
+	b.Count = count
+}
+
+// merge combines two aggregates of n and m readings.
+func (a HistoryAggregate) merge(o HistoryAggregate, n, m int) HistoryAggregate {
+	return HistoryAggregate{
+		Min: math.Min(a.Min, o.Min),
+		Max: math.Max(a.Max, o.Max),
+		Avg: (a.Avg*float64(n) + o.Avg*float64(m)) / float64(n+m),
+	}
+}
+
+// bucket returns a bucket with just the reading.
+func (p HistoryPoint) bucket() HistoryBucket {
+	return HistoryBucket{
+		Time:        p.Time,
+		Count:       1,
+		Temperature: HistoryAggregate{Min: p.Temperature, Max: p.Temperature, Avg: p.Temperature},
+		Humidity:    HistoryAggregate{Min: p.Humidity, Max: p.Humidity, Avg: p.Humidity},
+	}
+}
+
+// point returns the averages of the bucket as a reading at the start of the bucket.
+func (b HistoryBucket) point() HistoryPoint {
+	return HistoryPoint{Time: b.Time, Temperature: b.Temperature.Avg, Humidity: b.Humidity.Avg}
+}
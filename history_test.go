@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func historyTemperatures(points []HistoryPoint) []float64 {
+	var temperatures []float64
+	for _, p := range points {
+		temperatures = append(temperatures, p.Temperature)
+	}
+	return temperatures
+}
+
+func TestHistory_limit(t *testing.T) {
+	h := NewHistory(time.Hour, 3)
+	s := &SensorConfig{ID: "91"}
+
+	for i := 0; i < 5; i++ {
+		h.Write(&Reading{Sensor: s, Temperature: float64(i), Time: testTime.Add(time.Duration(i) * time.Minute)})
+	}
+
+	end := testTime.Add(time.Hour)
+	assert.Equal(t, []float64{2, 3, 4}, historyTemperatures(h.Get("91", testTime, end)), "Oldest readings are dropped")
+	assert.Equal(t, []float64{3, 4}, historyTemperatures(h.Get("91", testTime.Add(3*time.Minute), end)))
+	assert.Equal(t, []float64{2, 3}, historyTemperatures(h.Get("91", testTime, testTime.Add(3*time.Minute))))
+	assert.Empty(t, h.Get("92", testTime, end))
+}
+
+func TestHistory_window(t *testing.T) {
+	h := NewHistory(time.Hour, 10)
+	s := &SensorConfig{ID: "91"}
+
+	h.Write(&Reading{Sensor: s, Temperature: 1, Time: testTime})
+	h.Write(&Reading{Sensor: s, Temperature: 2, Time: testTime.Add(30 * time.Minute)})
+	h.Write(&Reading{Sensor: s, Temperature: 3, Time: testTime.Add(90 * time.Minute)})
+
+	assert.Equal(t, []float64{2, 3}, historyTemperatures(h.Get("91", testTime, testTime.Add(2*time.Hour))),
+		"Readings older than the window are dropped")
+}
+
+func TestDownsample(t *testing.T) {
+	points := []HistoryPoint{
+		{Time: testTime.Add(1 * time.Minute), Temperature: 4, Humidity: 60},
+		{Time: testTime.Add(3 * time.Minute), Temperature: 6, Humidity: 50},
+		{Time: testTime.Add(5 * time.Minute), Temperature: 5, Humidity: 55},
+		{Time: testTime.Add(17 * time.Minute), Temperature: 7, Humidity: 40},
+	}
+
+	assert.Equal(t, []HistoryBucket{
+		{
+			Time:        testTime,
+			Count:       2,
+			Temperature: HistoryAggregate{Min: 4, Max: 6, Avg: 5},
+			Humidity:    HistoryAggregate{Min: 50, Max: 60, Avg: 55},
+		},
+		{
+			Time:        testTime.Add(5 * time.Minute),
+			Count:       1,
+			Temperature: HistoryAggregate{Min: 5, Max: 5, Avg: 5},
+			Humidity:    HistoryAggregate{Min: 55, Max: 55, Avg: 55},
+		},
+		{
+			Time:        testTime.Add(15 * time.Minute),
+			Count:       1,
+			Temperature: HistoryAggregate{Min: 7, Max: 7, Avg: 7},
+			Humidity:    HistoryAggregate{Min: 40, Max: 40, Avg: 40},
+		},
+	}, downsample(points, testTime, 5*time.Minute), "Empty buckets are left out")
+	assert.Equal(t, []HistoryBucket{}, downsample(nil, testTime, time.Minute))
+}
+
+func TestParseConfig_history(t *testing.T) {
+	c, err := parseConfigString(`
+history:
+  retention: 2h
+`)
+	require.NoError(t, err)
+	assert.Equal(t, HistoryConfig{Retention: 2 * time.Hour, Limit: 4096}, c.History)
+
+	_, err = parseConfigString(`
+history:
+  retention: 0s
+  limit: -1
+`)
+	assert.EqualError(t, err, "history: retention must be positive, got 0s; history: limit must be positive, got -1")
+}
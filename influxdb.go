@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// influxUDPPayloadSize is the maximum size of a datagram sent to the UDP listener,
+// which stays below the usual MTU of 1500 bytes, so that datagrams aren't fragmented.
+const influxUDPPayloadSize = 1400
+
+// InfluxDBConfig configures writing readings to InfluxDB in line protocol.
+type InfluxDBConfig struct {
+	// URL of InfluxDB, either http(s):// for the HTTP API or udp://
+	// for the UDP listener (writing is disabled if not set)
+	URL string `mapstructure:"url"`
+	// Version of the HTTP API, either 1 or 2
+	Version int `mapstructure:"version"`
+	// Database and RetentionPolicy are used by the v1 API
+	Database        string `mapstructure:"database"`
+	RetentionPolicy string `mapstructure:"retention_policy"`
+	Username        string `mapstructure:"username"`
+	Password        string `mapstructure:"password"`
+	// Org, Bucket and Token are used by the v2 API
+	Org    string `mapstructure:"org"`
+	Bucket string `mapstructure:"bucket"`
+	Token  string `mapstructure:"token"`
+	// Measurement is the name of the measurement all readings are written to
+	Measurement string `mapstructure:"measurement"`
+	// BatchSize is the number of readings written at once
+	BatchSize int `mapstructure:"batch_size"`
+	// FlushInterval is the maximum time readings are batched before they are written
+	FlushInterval time.Duration `mapstructure:"flush_interval"`
+	Timeout       time.Duration `mapstructure:"timeout"`
+	// Retries is the number of times a failed write is retried, after 1s and twice as long before every further retry
+	Retries int `mapstructure:"retries"`
+	// BufferSize is the maximum number of readings kept while InfluxDB is unavailable,
+	// the oldest are dropped first
+	BufferSize int `mapstructure:"buffer_size"`
+}
+
+func (i InfluxDBConfig) validate() ValidationErrors {
+	var errs ValidationErrors
+	if i.URL == "" {
+		return errs
+	}
+
+	u, err := url.Parse(i.URL)
+	switch {
+	case err != nil || u.Host == "":
+		errs = append(errs, fmt.Errorf("influxdb: invalid url %q", i.URL))
+	case u.Scheme == "udp":
+	case u.Scheme == "http" || u.Scheme == "https":
+		switch i.Version {
+		case 1:
+			if i.Database == "" {
+				errs = append(errs, fmt.Errorf("influxdb: database must be set for version 1"))
+			}
+		case 2:
+			if i.Org == "" || i.Bucket == "" {
+				errs = append(errs, fmt.Errorf("influxdb: org and bucket must be set for version 2"))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("influxdb: version must be 1 or 2, got %d", i.Version))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("influxdb: invalid url %q (must be http://, https:// or udp://)", i.URL))
+	}
+
+	if i.Measurement == "" {
+		errs = append(errs, fmt.Errorf("influxdb: measurement must not be empty"))
+	}
+	if i.BatchSize <= 0 {
+		errs = append(errs, fmt.Errorf("influxdb: batch size must be positive, got %d", i.BatchSize))
+	}
+	if i.FlushInterval <= 0 {
+		errs = append(errs, fmt.Errorf("influxdb: flush interval must be positive, got %v", i.FlushInterval))
+	}
+	if i.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("influxdb: timeout must be positive, got %v", i.Timeout))
+	}
+	if i.Retries < 0 {
+		errs = append(errs, fmt.Errorf("influxdb: retries must not be negative, got %d", i.Retries))
+	}
+	if i.BufferSize < i.BatchSize {
+		errs = append(errs, fmt.Errorf("influxdb: buffer size must be at least the batch size, got %d",
+			i.BufferSize))
+	}
+	return errs
+}
+
+// influxOutput batches readings in line protocol and writes them to InfluxDB.
+// Lines that can't be written are kept (up to the buffer size) and written
+// with the next batch.
+type influxOutput struct {
+	sync.Mutex
+	// flushing is held while a batch is written and removed from lines,
+	// so that run and Exporter.Close don't write the same batch
+	flushing sync.Mutex
+	config   InfluxDBConfig
+	metrics  *sinkMetrics
+	client   *http.Client
+	backoff  time.Duration
+	lines    [][]byte
+	// dropped counts the lines dropped while a batch is written
+	dropped int
+	full    chan struct{}
+}
+
+func newInfluxOutput(c InfluxDBConfig, metrics *sinkMetrics) *influxOutput {
+	return &influxOutput{
+		config:  c,
+		metrics: metrics,
+		client:  &http.Client{Timeout: c.Timeout},
+		backoff: time.Second,
+		full:    make(chan struct{}, 1),
+	}
+}
+
+func (o *influxOutput) run(ctx context.Context) {
+	ticker := time.NewTicker(o.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-o.full:
+		}
+		o.flush()
+	}
+}
+
+// Name identifies the InfluxDB output as sink.
+func (o *influxOutput) Name() string {
+	return "influxdb"
+}
+
+// Write adds a reading to the batch, which is written by run.
+func (o *influxOutput) Write(r *Reading) error {
+	o.add(r)
+	return nil
+}
+
+// batching marks the InfluxDB output as batchingSink, as flush counts the written readings.
+func (o *influxOutput) batching() {}
+
+// add queues a reading, which is written as soon as the batch is full.
+func (o *influxOutput) add(r *Reading) {
+	o.Lock()
+	defer o.Unlock()
+
+	o.lines = append(o.lines, influxLine(o.config.Measurement, r))
+	if dropped := len(o.lines) - o.config.BufferSize; dropped > 0 {
+		log.Printf("InfluxDB buffer is full, dropping %d oldest readings", dropped)
+		o.lines = o.lines[dropped:]
+		o.dropped += dropped
+		o.metrics.readings.WithLabelValues(o.Name(), "dropped").Add(float64(dropped))
+	}
+
+	if len(o.lines) >= o.config.BatchSize {
+		select {
+		case o.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// flush writes all queued readings in batches and counts them in the sink metrics.
+// Readings that are rejected are dropped, the others are kept until InfluxDB is available again.
+func (o *influxOutput) flush() {
+	o.flushing.Lock()
+	defer o.flushing.Unlock()
+
+	for {
+		o.Lock()
+		n := len(o.lines)
+		if n > o.config.BatchSize {
+			n = o.config.BatchSize
+		}
+		batch := o.lines[:n]
+		o.dropped = 0
+		o.Unlock()
+
+		if n == 0 {
+			return
+		}
+
+		err := o.write(bytes.Join(batch, nil))
+		if err != nil {
+			log.Println(err)
+			if _, ok := err.(permanentError); !ok {
+				o.metrics.up.WithLabelValues(o.Name()).Set(0)
+				return
+			}
+		}
+
+		o.Lock()
+		// lines dropped meanwhile have already been counted
+		written := n - o.dropped
+		if written > 0 {
+			o.lines = o.lines[written:]
+		} else {
+			written = 0
+		}
+		o.Unlock()
+
+		if err != nil {
+			o.metrics.failed(o.Name(), written)
+		} else {
+			o.metrics.written(o.Name(), written)
+		}
+	}
+}
+
+// write sends a batch of lines and retries it with exponential backoff, unless it is rejected.
+func (o *influxOutput) write(data []byte) error {
+	u, err := url.Parse(o.config.URL)
+	if err != nil {
+		return permanentError{err}
+	}
+	if u.Scheme == "udp" {
+		return o.countError(o.writeUDP(u.Host, data))
+	}
+
+	return retry(o.config.Retries, o.backoff, func() error {
+		return o.countError(o.writeHTTP(data))
+	})
+}
+
+// countError counts a failed attempt to write a batch in the sink metrics.
+func (o *influxOutput) countError(err error) error {
+	if err != nil {
+		o.metrics.writeErrors.WithLabelValues(o.Name()).Inc()
+	}
+	return err
+}
+
+func (o *influxOutput) writeHTTP(data []byte) error {
+	req, err := http.NewRequest(http.MethodPost, o.writeURL(), bytes.NewReader(data))
+	if err != nil {
+		return permanentError{errors.Wrapf(err, "Failed to write to InfluxDB '%s'", o.config.URL)}
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if o.config.Version == 2 && o.config.Token != "" {
+		req.Header.Set("Authorization", "Token "+o.config.Token)
+	} else if o.config.Username != "" {
+		req.SetBasicAuth(o.config.Username, o.config.Password)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write to InfluxDB '%s'", o.config.URL)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	err = errors.Errorf("Failed to write to InfluxDB '%s': %s: %s", o.config.URL, resp.Status, bytes.TrimSpace(body))
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+		return permanentError{err}
+	}
+	return err
+}
+
+// writeUDP sends the lines in as few datagrams of at most influxUDPPayloadSize as possible
+// (a longer line is sent on its own).
+func (o *influxOutput) writeUDP(addr string, data []byte) error {
+	conn, err := net.DialTimeout("udp", addr, o.config.Timeout)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write to InfluxDB '%s'", o.config.URL)
+	}
+	defer conn.Close()
+
+	var datagram []byte
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		if len(datagram) > 0 && len(datagram)+len(line) > influxUDPPayloadSize {
+			if _, err := conn.Write(datagram); err != nil {
+				return errors.Wrapf(err, "Failed to write to InfluxDB '%s'", o.config.URL)
+			}
+			datagram = nil
+		}
+		datagram = append(datagram, line...)
+	}
+	if len(datagram) == 0 {
+		return nil
+	}
+	_, err = conn.Write(datagram)
+	return errors.Wrapf(err, "Failed to write to InfluxDB '%s'", o.config.URL)
+}
+
+// writeURL returns the URL of the write endpoint of the configured API version.
+func (o *influxOutput) writeURL() string {
+	c := o.config
+	params := url.Values{}
+	path := "/write"
+	if c.Version == 2 {
+		path = "/api/v2/write"
+		params.Set("org", c.Org)
+		params.Set("bucket", c.Bucket)
+	} else {
+		params.Set("db", c.Database)
+		if c.RetentionPolicy != "" {
+			params.Set("rp", c.RetentionPolicy)
+		}
+	}
+	params.Set("precision", "ns")
+	return strings.TrimSuffix(c.URL, "/") + path + "?" + params.Encode()
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxKeyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// influxLine converts a reading into a line of the line protocol with
+// id, location, protocol and the labels of the sensor as tags.
+func influxLine(measurement string, r *Reading) []byte {
+	tags := map[string]string{
+		SensorID:       r.Sensor.ID,
+		SensorLocation: r.Sensor.Location,
+		SensorProtocol: r.Sensor.Protocol,
+	}
+	for name, value := range r.Sensor.Labels {
+		tags[name] = value
+	}
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b bytes.Buffer
+	b.WriteString(influxMeasurementEscaper.Replace(measurement))
+	for _, name := range names {
+		if tags[name] == "" {
+			continue
+		}
+		b.WriteString("," + influxKeyEscaper.Replace(name) + "=" + influxKeyEscaper.Replace(tags[name]))
+	}
+	fmt.Fprintf(&b, " temperature=%s,humidity=%s,low_battery=%t %d\n",
+		strconv.FormatFloat(r.Temperature, 'f', -1, 64),
+		strconv.FormatFloat(r.Humidity, 'f', -1, 64),
+		r.LowBattery,
+		r.Time.UnixNano())
+	return b.Bytes()
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInfluxLine(t *testing.T) {
+	s := &SensorConfig{ID: "91", Location: "living room", Protocol: "weather12",
+		Labels: map[string]string{"floor": "1", "site": "a,b=c", "empty": ""}}
+
+	line := influxLine("weather", &Reading{Sensor: s, Temperature: 21.5, Humidity: 45, LowBattery: true, Time: testTime})
+
+	assert.Equal(t, `weather,floor=1,id=91,location=living\ room,protocol=weather12,site=a\,b\=c `+
+		"temperature=21.5,humidity=45,low_battery=true 1570397368000000000\n", string(line))
+}
+
+func newTestInfluxOutput(t *testing.T, yaml string) *influxOutput {
+	c, err := parseConfigString(yaml)
+	require.NoError(t, err)
+
+	o := newInfluxOutput(c.InfluxDB, newSinkMetrics(prometheus.NewRegistry(), c.Metrics))
+	o.backoff = time.Millisecond
+	return o
+}
+
+func testReading(temperature float64) *Reading {
+	s := &SensorConfig{ID: "91", Location: "fridge", Protocol: "weather12"}
+	return &Reading{Sensor: s, Temperature: temperature, Humidity: 60, Time: testTime}
+}
+
+func TestInfluxOutput_v1(t *testing.T) {
+	var bodies []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/write?db=weather&precision=ns&rp=autogen", r.URL.String())
+		user, password, _ := r.BasicAuth()
+		assert.Equal(t, "pi", user)
+		assert.Equal(t, "secret", password)
+
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	o := newTestInfluxOutput(t, `
+influxdb:
+  url: `+s.URL+`
+  database: weather
+  retention_policy: autogen
+  username: pi
+  password: secret
+  batch_size: 2
+`)
+
+	o.add(testReading(4.2))
+	o.add(testReading(4.3))
+	o.add(testReading(4.4))
+	o.flush()
+
+	require.Len(t, bodies, 2, "Readings are written in batches")
+	assert.Equal(t,
+		"weather,id=91,location=fridge,protocol=weather12 temperature=4.2,humidity=60,low_battery=false 1570397368000000000\n"+
+			"weather,id=91,location=fridge,protocol=weather12 temperature=4.3,humidity=60,low_battery=false 1570397368000000000\n",
+		bodies[0])
+	assert.Empty(t, o.lines)
+}
+
+func TestInfluxOutput_v2(t *testing.T) {
+	var requests int
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v2/write?bucket=weather&org=home&precision=ns", r.URL.String())
+		assert.Equal(t, "Token secret", r.Header.Get("Authorization"))
+		requests++
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	o := newTestInfluxOutput(t, `
+influxdb:
+  url: `+s.URL+`
+  version: 2
+  org: home
+  bucket: weather
+  token: secret
+`)
+
+	o.add(testReading(4.2))
+	o.flush()
+
+	assert.Equal(t, 1, requests)
+}
+
+func TestInfluxOutput_keepsReadingsWhileUnavailable(t *testing.T) {
+	available := false
+	var requests int
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if !available {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	o := newTestInfluxOutput(t, `
+influxdb:
+  url: `+s.URL+`
+  database: weather
+  retries: 1
+  batch_size: 1
+  buffer_size: 2
+`)
+	registry := prometheus.NewRegistry()
+	o.metrics = newSinkMetrics(registry, MetricsConfig{Namespace: "meter"})
+
+	o.add(testReading(4.2))
+	o.add(testReading(4.3))
+	o.flush()
+
+	assert.Equal(t, 2, requests, "Retried once")
+	assert.Len(t, o.lines, 2)
+	assert.Equal(t, 2.0, sinkMetric(t, registry, "meter_sink_write_errors_total", ""))
+	assert.Equal(t, 0.0, sinkMetric(t, registry, "meter_sink_up", ""))
+
+	o.add(testReading(4.4))
+	assert.Len(t, o.lines, 2, "Oldest reading is dropped")
+	assert.Contains(t, string(o.lines[0]), "temperature=4.3")
+	assert.Equal(t, 1.0, sinkMetric(t, registry, "meter_sink_readings_total", "dropped"))
+
+	available = true
+	o.flush()
+	assert.Equal(t, 4, requests)
+	assert.Empty(t, o.lines)
+	assert.Equal(t, 2.0, sinkMetric(t, registry, "meter_sink_readings_total", "written"))
+	assert.Equal(t, 1.0, sinkMetric(t, registry, "meter_sink_up", ""))
+}
+
+func TestInfluxOutput_dropsRejectedReadings(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"unable to parse"}`, http.StatusBadRequest)
+	}))
+	defer s.Close()
+
+	o := newTestInfluxOutput(t, `
+influxdb:
+  url: `+s.URL+`
+  database: weather
+`)
+	registry := prometheus.NewRegistry()
+	o.metrics = newSinkMetrics(registry, MetricsConfig{Namespace: "meter"})
+
+	o.add(testReading(4.2))
+	o.flush()
+
+	assert.Empty(t, o.lines)
+	assert.Equal(t, 1.0, sinkMetric(t, registry, "meter_sink_readings_total", "failed"))
+	assert.Equal(t, 0.0, sinkMetric(t, registry, "meter_sink_up", ""))
+}
+
+func TestInfluxOutput_udp(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	o := newTestInfluxOutput(t, `
+influxdb:
+  url: udp://`+conn.LocalAddr().String()+`
+`)
+
+	o.add(testReading(4.2))
+	o.flush()
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "weather,id=91,location=fridge,protocol=weather12 "+
+		"temperature=4.2,humidity=60,low_battery=false 1570397368000000000\n", string(buf[:n]))
+}
+
+func TestInfluxOutput_udpDatagramSize(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	o := newTestInfluxOutput(t, `
+influxdb:
+  url: udp://`+conn.LocalAddr().String()+`
+`)
+	for i := 0; i < 40; i++ {
+		o.add(testReading(float64(i)))
+	}
+	o.flush()
+
+	var lines int
+	buf := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for lines < 40 {
+		n, _, err := conn.ReadFrom(buf)
+		require.NoError(t, err)
+		assert.True(t, n <= influxUDPPayloadSize, "Datagram of %d bytes", n)
+		assert.True(t, bytes.HasSuffix(buf[:n], []byte("\n")), "Lines are not split")
+		lines += bytes.Count(buf[:n], []byte("\n"))
+	}
+	assert.Equal(t, 40, lines)
+}
+
+func TestInfluxOutput_concurrentFlushes(t *testing.T) {
+	var mu sync.Mutex
+	var lines int
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		lines += bytes.Count(body, []byte("\n"))
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	o := newTestInfluxOutput(t, `
+influxdb:
+  url: `+s.URL+`
+  database: weather
+  batch_size: 2
+`)
+	for i := 0; i < 20; i++ {
+		o.add(testReading(float64(i)))
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			o.flush()
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 20, lines, "Every reading is written once")
+	assert.Empty(t, o.lines)
+}
+
+func TestParseConfig_invalidInfluxDB(t *testing.T) {
+	_, err := parseConfigString(`
+influxdb:
+  url: http://localhost:8086
+  version: 2
+  batch_size: 0
+`)
+
+	assert.EqualError(t, err, "influxdb: org and bucket must be set for version 2; "+
+		"influxdb: batch size must be positive, got 0")
+}
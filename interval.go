@@ -0,0 +1,127 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// burstWindow is the time within which signals of the same sensor
+	// are repetitions of a single transmission
+	burstWindow = 2 * time.Second
+	// recentGaps is the number of most recent gaps between transmissions used to
+	// learn the interval of a sensor and to compute the reception quality
+	recentGaps = 32
+)
+
+// IntervalStats are the statistics about the transmissions of a sensor.
+type IntervalStats struct {
+	// Interval is the configured or learned time between two transmissions
+	Interval time.Duration
+	// LossRatio is the estimated ratio of missed transmissions since start
+	LossRatio float64
+	// Quality is the estimated ratio of received transmissions within the recent gaps
+	Quality float64
+}
+
+// IntervalTracker tracks the times between transmissions of sensors to
+// estimate how many transmissions have been missed, e.g. due to range problems.
+type IntervalTracker struct {
+	sync.Mutex
+	sensors map[string]*transmissions
+}
+
+type transmissions struct {
+	last     time.Time
+	gaps     []time.Duration // most recent gaps first
+	received int
+	missed   int
+	stats    *IntervalStats
+}
+
+// NewIntervalTracker creates an IntervalTracker without any transmissions.
+func NewIntervalTracker() *IntervalTracker {
+	return &IntervalTracker{
+		sensors: map[string]*transmissions{},
+	}
+}
+
+// Observe records the reception of a reading and returns the gap since the previous
+// transmission of the sensor together with the updated statistics. It returns false if
+// the reading is a repetition of the previous transmission or the interval is still unknown.
+func (it *IntervalTracker) Observe(r *Reading) (time.Duration, IntervalStats, bool) {
+	it.Lock()
+	defer it.Unlock()
+
+	t, ok := it.sensors[r.Sensor.ID]
+	if !ok {
+		it.sensors[r.Sensor.ID] = &transmissions{last: r.Time, received: 1}
+		return 0, IntervalStats{}, false
+	}
+
+	gap := r.Time.Sub(t.last)
+	if gap < burstWindow {
+		return 0, IntervalStats{}, false
+	}
+	t.last = r.Time
+	t.received++
+	t.gaps = append([]time.Duration{gap}, t.gaps...)
+	if len(t.gaps) > recentGaps {
+		t.gaps = t.gaps[:recentGaps]
+	}
+
+	interval := r.Sensor.Interval
+	if interval == 0 {
+		interval = t.learnedInterval()
+	}
+
+	t.missed += missedTransmissions(gap, interval)
+
+	expected := 0
+	for _, g := range t.gaps {
+		expected += missedTransmissions(g, interval) + 1
+	}
+
+	t.stats = &IntervalStats{
+		Interval:  interval,
+		LossRatio: float64(t.missed) / float64(t.received-1+t.missed),
+		Quality:   float64(len(t.gaps)) / float64(expected),
+	}
+	return gap, *t.stats, true
+}
+
+// Stats returns the latest statistics of a sensor or false
+// if the interval of the sensor is still unknown.
+func (it *IntervalTracker) Stats(id string) (IntervalStats, bool) {
+	it.Lock()
+	defer it.Unlock()
+
+	t, ok := it.sensors[id]
+	if !ok || t.stats == nil {
+		return IntervalStats{}, false
+	}
+	return *t.stats, true
+}
+
+// learnedInterval is the shortest recent gap, as missed
+// transmissions only make gaps longer.
+func (t *transmissions) learnedInterval() time.Duration {
+	interval := t.gaps[0]
+	for _, g := range t.gaps {
+		if g < interval {
+			interval = g
+		}
+	}
+	return interval
+}
+
+// missedTransmissions estimates the number of transmissions
+// that have been missed within a gap.
+func missedTransmissions(gap, interval time.Duration) int {
+	missed := int(math.Round(float64(gap)/float64(interval))) - 1
+	if missed < 0 {
+		return 0
+	}
+	return missed
+}
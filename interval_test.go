@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIntervalTracker_configuredInterval(t *testing.T) {
+	it := NewIntervalTracker()
+	s := &SensorConfig{ID: "91", Location: "fridge", Interval: time.Minute}
+
+	_, _, ok := it.Observe(&Reading{Sensor: s, Time: testTime})
+	assert.False(t, ok, "No gap after first transmission")
+
+	_, _, ok = it.Observe(&Reading{Sensor: s, Time: testTime.Add(500 * time.Millisecond)})
+	assert.False(t, ok, "Repetition of the same transmission is ignored")
+
+	gap, stats, ok := it.Observe(&Reading{Sensor: s, Time: testTime.Add(61 * time.Second)})
+	assert.True(t, ok)
+	assert.Equal(t, 61*time.Second, gap)
+	assert.Equal(t, IntervalStats{Interval: time.Minute, LossRatio: 0, Quality: 1}, stats)
+
+	// two transmissions have been missed
+	gap, stats, ok = it.Observe(&Reading{Sensor: s, Time: testTime.Add(241 * time.Second)})
+	assert.True(t, ok)
+	assert.Equal(t, 180*time.Second, gap)
+	assert.Equal(t, time.Minute, stats.Interval)
+	assert.InDelta(t, 0.5, stats.LossRatio, 1e-9)
+	assert.InDelta(t, 0.5, stats.Quality, 1e-9)
+}
+
+func TestIntervalTracker_learnedInterval(t *testing.T) {
+	it := NewIntervalTracker()
+	s := &SensorConfig{ID: "91", Location: "fridge"}
+
+	it.Observe(&Reading{Sensor: s, Time: testTime})
+	_, stats, _ := it.Observe(&Reading{Sensor: s, Time: testTime.Add(112 * time.Second)})
+	assert.Equal(t, 112*time.Second, stats.Interval)
+
+	_, stats, _ = it.Observe(&Reading{Sensor: s, Time: testTime.Add(168 * time.Second)})
+	assert.Equal(t, 56*time.Second, stats.Interval, "Shortest gap is the interval")
+	assert.InDelta(t, 0, stats.LossRatio, 1e-9, "Loss is counted from the interval known at the time")
+	assert.InDelta(t, 0.67, stats.Quality, 0.01, "Recent gaps are re-evaluated with the learned interval")
+}
+
+func TestMissedTransmissions(t *testing.T) {
+	assert.Equal(t, 0, missedTransmissions(50*time.Second, time.Minute))
+	assert.Equal(t, 0, missedTransmissions(80*time.Second, time.Minute))
+	assert.Equal(t, 1, missedTransmissions(100*time.Second, time.Minute))
+	assert.Equal(t, 4, missedTransmissions(5*time.Minute, time.Minute))
+}
@@ -5,10 +5,8 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"strings"
+	"os"
 
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
@@ -17,10 +15,14 @@ var (
 		Default("/dev/ttyUSB0").String()
 	listenAddr = kingpin.Flag("listen-address", "The address to listen on for HTTP requests").
 			Default(":8080").String()
-	configFile = kingpin.Arg("config.yaml", "Path to config file.").String()
+	textfile = kingpin.Flag("textfile", "Write metrics to this .prom file for node_exporter's "+
+		"textfile collector instead of serving them via HTTP").String()
 
-	temperature *prometheus.GaugeVec
-	humidity    *prometheus.GaugeVec
+	runCmd     = kingpin.Command("run", "Receive signals and export them to Prometheus.").Default()
+	configFile = runCmd.Arg("config.yaml", "Path to config file.").String()
+
+	validateCmd        = kingpin.Command("validate-config", "Validate the config file and report all errors.")
+	validateConfigFile = validateCmd.Arg("config.yaml", "Path to config file.").String()
 )
 
 const (
@@ -28,16 +30,69 @@ const (
 	SensorID = "id"
 	// SensorLocation is the location where the sensor is placed
 	SensorLocation = "location"
+	// SensorProtocol is the protocol used to decode signals of the sensor
+	SensorProtocol = "protocol"
+	// SensorChannel is the channel the sensor transmits on
+	SensorChannel = "channel"
 )
 
 func main() {
-	kingpin.Parse()
+	switch kingpin.Parse() {
+	case validateCmd.FullCommand():
+		os.Exit(validateConfig(*validateConfigFile))
+	case runCmd.FullCommand():
+		run()
+	}
+}
 
-	loadConfig(*configFile)
+// validateConfig reports all errors of the config file and
+// returns the exit code of the validate-config command.
+func validateConfig(configFile string) int {
+	initConfig(configFile)
+	if err := vip.ReadInConfig(); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	_, err := parseConfig(vip)
+	if errs, ok := err.(ValidationErrors); ok {
+		for _, e := range errs {
+			fmt.Println(e)
+		}
+		return 1
+	}
 
-	setupMetrics()
+	fmt.Printf("Config file '%s' is valid\n", vip.ConfigFileUsed())
+	return 0
+}
+
+func run() {
+	c, err := loadConfig(*configFile)
+	if err != nil {
+		log.Fatalf("Invalid config file: %v", err)
+	}
+
+	if *textfile != "" {
+		// node_exporter already exposes metrics about itself
+		// and rejects metrics with timestamps
+		c.Metrics.GoCollector = false
+		c.Metrics.ProcessCollector = false
+		c.Metrics.Timestamps = false
+	}
+
+	c.OTLP.Device = *device
+
+	e, err := NewExporter(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *textfile != "" {
+		if err := e.EnableTextfile(*textfile); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	http.Handle("/metrics", promhttp.Handler())
 	SetupDevice(*device)
 	dev, err := OpenDevice(*device)
 	if err != nil {
@@ -50,32 +105,29 @@ func main() {
 		log.Fatalf("Could not reset '%v'", *device)
 	}
 
-	go receive(dev)
+	if err := e.StartOutputs(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	e.DeviceConnected(*device)
 
-	log.Printf("Serving metrics at '%v/metrics'", *listenAddr)
-	log.Fatal(http.ListenAndServe(*listenAddr, nil))
-}
+	if *textfile != "" {
+		log.Printf("Writing metrics to '%v'", *textfile)
+		receive(dev, e.DecodedSignal)
+		e.Close()
+		return
+	}
+
+	go func() {
+		receive(dev, e.DecodedSignal)
+		// the Arduino has been disconnected
+		e.Close()
+	}()
 
-func setupMetrics() {
-	temperature = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "meter_temperature_celsius",
-		Help: "Current temperature in Celsius",
-	}, []string{
-		SensorID,
-		SensorLocation,
-	})
-	humidity = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "meter_humidity_percent",
-		Help: "Current humidity level in %",
-	}, []string{
-		SensorID,
-		SensorLocation,
-	})
-	prometheus.MustRegister(temperature)
-	prometheus.MustRegister(humidity)
+	log.Printf("Serving metrics at '%v/metrics'", *listenAddr)
+	log.Fatal(http.ListenAndServe(*listenAddr, e.Handler()))
 }
 
-func receive(a *Device) {
+func receive(a *Device, handle ProcessorFunc) {
 	// tell the Arduino to start receiving signals
 	err := a.Write(ReceiveCmd)
 	if err != nil {
@@ -85,97 +137,8 @@ func receive(a *Device) {
 
 	ctx := context.Background()
 	// read and decode received signals forever
-	err = a.Process(ctx, DecodedSignal)
+	err = a.Process(ctx, handle)
 	if err != nil {
 		log.Println(err)
 	}
 }
-
-// DecodedSignal decodes a compressed signal read from the Arduino
-// by trying all currently supported protocols and stores result for Prometheus scraping
-func DecodedSignal(line string) (stop bool) {
-	stop = false
-
-	if strings.HasPrefix(line, ReceivePrefix) {
-		trimmed := strings.TrimPrefix(line, ReceivePrefix)
-
-		pulse, err := PreparePulse(trimmed)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-
-		matchingProtocols := MatchingProtocols(pulse)
-
-		if !processedWithMatchingConfig(matchingProtocols, pulse) {
-			printAllMatchingProtocols(matchingProtocols, pulse)
-		}
-
-	}
-	return
-}
-
-func printAllMatchingProtocols(matchingProtocols []string, pulse *Signal) {
-	firstMatch := true
-	for _, p := range matchingProtocols {
-		result, err := DecodePulse(pulse, p)
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-		m := result.(*GTWT01Result)
-		if firstMatch {
-			log.Println("Sensor has no matching configuration, potential protocols:")
-			firstMatch = false
-		}
-		log.Printf("%v: %+v\n", p, *m)
-	}
-	if firstMatch {
-		log.Println("Unsupported protocol or error decoding the pulse")
-	} else {
-		log.Println("Add to configuration with appropriate protocol")
-	}
-}
-
-func processedWithMatchingConfig(matchingProtocols []string, pulse *Signal) bool {
-	protocolMatch := false
-	configuredSensors := vip.GetStringMap("sensors")
-	for id := range configuredSensors {
-		location := vip.GetString(fmt.Sprintf("sensors.%s.location", id))
-		if location == "" {
-			panic(fmt.Errorf("fatal error sensor id %s has no location specified in config file", id))
-		}
-		protocol := vip.GetString(fmt.Sprintf("sensors.%s.protocol", id))
-		if protocol == "" {
-			panic(fmt.Errorf("fatal error sensor id %s has no protocol specified in config file", id))
-		}
-
-		for _, p := range matchingProtocols {
-			if p == protocol {
-				result, err := DecodePulse(pulse, protocol)
-				if err != nil {
-					log.Println(err)
-					break
-				}
-				m := result.(*GTWT01Result)
-				if m.Name == id {
-					temperature.With(prometheus.Labels{
-						SensorID:       m.Name,
-						SensorLocation: location,
-					}).Set(m.Temperature)
-
-					humidity.With(prometheus.Labels{
-						SensorID:       m.Name,
-						SensorLocation: location,
-					}).Set(float64(m.Humidity))
-					log.Printf("%v: %+v\n", location, *m)
-					protocolMatch = true
-					break
-				}
-
-			}
-		}
-	}
-
-	return protocolMatch
-}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricsConfig configures how metrics are exposed.
+type MetricsConfig struct {
+	// Timestamps exposes sensor values with the time they have been received
+	Timestamps bool `mapstructure:"timestamps"`
+	// GoCollector exposes metrics about the Go runtime
+	GoCollector bool `mapstructure:"go_collector"`
+	// ProcessCollector exposes metrics about the process (CPU, memory, file descriptors)
+	ProcessCollector bool `mapstructure:"process_collector"`
+	// Namespace is the prefix of all metric names
+	Namespace string `mapstructure:"namespace"`
+	// Names renames metrics, keyed by their default name without namespace
+	Names map[string]string `mapstructure:"names"`
+	// HumidityUnit is the unit humidity is exported in, either percent or ratio
+	HumidityUnit string `mapstructure:"humidity_unit"`
+	// Labels are constant labels added to all metrics
+	Labels map[string]string `mapstructure:"labels"`
+}
+
+const (
+	// HumidityPercent exports humidity in % (0-100)
+	HumidityPercent = "percent"
+	// HumidityRatio exports humidity as ratio (0-1)
+	HumidityRatio = "ratio"
+)
+
+var humidityUnits = map[string]string{
+	HumidityPercent: "in %",
+	HumidityRatio:   "as ratio from 0 to 1",
+}
+
+// metricNames are the default names of all metrics without namespace.
+var metricNames = []string{
+	"receiver_lines_read_total",
+	"receiver_signals_received_total",
+	"receiver_prepare_errors_total",
+	"receiver_protocol_matches_total",
+	"receiver_decode_errors_total",
+	"receiver_unconfigured_signals_total",
+	"receiver_decode_duration_seconds",
+	"interarrival_seconds",
+	"temperature_celsius",
+	"humidity_percent",
+	"humidity_ratio",
+	"temperature_raw_celsius",
+	"humidity_raw_percent",
+	"humidity_raw_ratio",
+	"dew_point_celsius",
+	"absolute_humidity_grams_per_cubic_meter",
+	"vapor_pressure_deficit_pascals",
+	"heat_index_celsius",
+	"battery_low",
+	"last_seen_timestamp_seconds",
+	"sensor_info",
+	"mold_index",
+	"ventilation_absolute_humidity_difference_grams_per_cubic_meter",
+	"ventilation_recommended",
+	"transmission_interval_seconds",
+	"packet_loss_ratio",
+	"reception_quality_ratio",
+	"unknown_sensor_info",
+	"sink_readings_total",
+	"sink_write_errors_total",
+	"sink_queue_length",
+	"sink_up",
+}
+
+var (
+	metricNameRE = regexp.MustCompile("^[a-zA-Z_:][a-zA-Z0-9_:]*$")
+	labelNameRE  = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+)
+
+// reservedLabels are set by the exporter itself and can't be configured.
+var reservedLabels = map[string]bool{
+	SensorID: true, SensorLocation: true, SensorProtocol: true, SensorChannel: true, "le": true, "quantile": true,
+	// labels of the sink metrics
+	"sink": true, "result": true,
+}
+
+// metricName returns the name of a metric, given its default name without namespace.
+func (m MetricsConfig) metricName(name string) string {
+	if renamed, ok := m.Names[name]; ok {
+		name = renamed
+	}
+	return prometheus.BuildFQName(m.Namespace, "", name)
+}
+
+// humidity converts a humidity level in % to the configured unit.
+func (m MetricsConfig) humidity(percent float64) float64 {
+	if m.HumidityUnit == HumidityRatio {
+		return percent / 100
+	}
+	return percent
+}
+
+func (m MetricsConfig) validate() ValidationErrors {
+	var errs ValidationErrors
+
+	if m.Namespace != "" && !labelNameRE.MatchString(m.Namespace) {
+		errs = append(errs, fmt.Errorf("metrics namespace %q is invalid", m.Namespace))
+	}
+
+	if humidityUnits[m.HumidityUnit] == "" {
+		errs = append(errs, fmt.Errorf("metrics humidity unit %q is invalid (supported: %s, %s)",
+			m.HumidityUnit, HumidityPercent, HumidityRatio))
+	}
+
+	known := map[string]bool{}
+	for _, name := range metricNames {
+		known[name] = true
+	}
+	for _, name := range sortedKeys(m.Names) {
+		if !known[name] {
+			errs = append(errs, fmt.Errorf("metrics names: unknown metric %q", name))
+		} else if !metricNameRE.MatchString(m.Names[name]) {
+			errs = append(errs, fmt.Errorf("metrics names: metric %q has invalid name %q", name, m.Names[name]))
+		}
+	}
+
+	names := map[string]string{}
+	for _, name := range metricNames {
+		fqName := m.metricName(name)
+		if other, ok := names[fqName]; ok {
+			errs = append(errs, fmt.Errorf("metrics names: metrics %q and %q are both named %q",
+				other, name, fqName))
+		}
+		names[fqName] = name
+	}
+
+	for _, err := range validateLabels(m.Labels) {
+		errs = append(errs, fmt.Errorf("metrics labels: %v", err))
+	}
+	return errs
+}
+
+// validateLabels checks that constant labels have valid names,
+// which are not used by the exporter itself, and safe values.
+func validateLabels(labels map[string]string) ValidationErrors {
+	var errs ValidationErrors
+	for _, name := range sortedKeys(labels) {
+		switch {
+		case !labelNameRE.MatchString(name) || strings.HasPrefix(name, "__"):
+			errs = append(errs, fmt.Errorf("label name %q is invalid", name))
+		case reservedLabels[name]:
+			errs = append(errs, fmt.Errorf("label name %q is reserved", name))
+		case !labelSafe(labels[name]):
+			errs = append(errs, fmt.Errorf("label %s has invalid value %q", name, labels[name]))
+		}
+	}
+	return errs
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sensorLabelNames returns the names of the labels of all metrics of a sensor:
+// its id, location and the labels configured for any of the sensors.
+func (c *Config) sensorLabelNames() []string {
+	configured := map[string]bool{}
+	for _, s := range c.Sensors {
+		for name := range s.Labels {
+			configured[name] = true
+		}
+	}
+
+	names := make([]string, 0, len(configured))
+	for name := range configured {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return append([]string{SensorID, SensorLocation}, names...)
+}
+
+// sensorLabelValues returns the values of the labels of all metrics of a sensor
+// in the order of sensorLabelNames. Labels not configured for the sensor are empty.
+func (e *Exporter) sensorLabelValues(s *SensorConfig) []string {
+	values := []string{s.ID, s.Location}
+	for _, name := range e.sensorLabels[2:] {
+		values = append(values, s.Labels[name])
+	}
+	return values
+}
+
+// receiverMetrics show the health of the radio link
+// and of the pipeline decoding received signals.
+type receiverMetrics struct {
+	linesRead           prometheus.Counter
+	signalsReceived     prometheus.Counter
+	prepareErrors       prometheus.Counter
+	protocolMatches     *prometheus.CounterVec
+	decodeFailures      prometheus.Counter
+	unconfiguredSignals prometheus.Counter
+	decodeDuration      prometheus.Histogram
+	interArrival        *prometheus.HistogramVec
+}
+
+func newReceiverMetrics(r prometheus.Registerer, c MetricsConfig, sensorLabels []string) *receiverMetrics {
+	labels := prometheus.Labels(c.Labels)
+	m := &receiverMetrics{
+		linesRead: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        c.metricName("receiver_lines_read_total"),
+			Help:        "Number of lines read from the Arduino",
+			ConstLabels: labels,
+		}),
+		signalsReceived: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        c.metricName("receiver_signals_received_total"),
+			Help:        "Number of signals received via RF",
+			ConstLabels: labels,
+		}),
+		prepareErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        c.metricName("receiver_prepare_errors_total"),
+			Help:        "Number of received signals that could not be prepared for decoding",
+			ConstLabels: labels,
+		}),
+		protocolMatches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        c.metricName("receiver_protocol_matches_total"),
+			Help:        "Number of received signals matching a protocol",
+			ConstLabels: labels,
+		}, []string{
+			SensorProtocol,
+		}),
+		decodeFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        c.metricName("receiver_decode_errors_total"),
+			Help:        "Number of received signals that could not be decoded with any protocol",
+			ConstLabels: labels,
+		}),
+		unconfiguredSignals: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        c.metricName("receiver_unconfigured_signals_total"),
+			Help:        "Number of decoded signals of sensors that are not configured",
+			ConstLabels: labels,
+		}),
+		decodeDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:        c.metricName("receiver_decode_duration_seconds"),
+			Help:        "Time it takes to decode a received signal",
+			ConstLabels: labels,
+			Buckets:     prometheus.ExponentialBuckets(0.0001, 2, 12),
+		}),
+		interArrival: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:        c.metricName("interarrival_seconds"),
+			Help:        "Time between two received transmissions of the sensor",
+			ConstLabels: labels,
+			Buckets:     []float64{15, 30, 45, 60, 90, 120, 180, 300, 600, 1200},
+		}, sensorLabels),
+	}
+
+	r.MustRegister(
+		m.linesRead,
+		m.signalsReceived,
+		m.prepareErrors,
+		m.protocolMatches,
+		m.decodeFailures,
+		m.unconfiguredSignals,
+		m.decodeDuration,
+		m.interArrival,
+	)
+	return m
+}
+
+// prometheusSink stores readings for the sensor collector and
+// updates the statistics depending on the history of readings.
+type prometheusSink struct {
+	exporter *Exporter
+}
+
+// Name identifies the Prometheus metrics as sink.
+func (prometheusSink) Name() string {
+	return "prometheus"
+}
+
+// Write stores a reading for the next scrape and updates the statistics of its sensor.
+func (s prometheusSink) Write(r *Reading) error {
+	e := s.exporter
+	e.readings.Set(r)
+
+	if gap, _, ok := e.intervals.Observe(r); ok {
+		e.metrics.interArrival.WithLabelValues(e.sensorLabelValues(r.Sensor)...).Observe(gap.Seconds())
+	}
+
+	if r.Sensor.MoldRisk {
+		e.moldRisk.Update(r)
+	}
+	return nil
+}
+
+// sensorCollector renders the current readings of all sensors on scrape.
+type sensorCollector struct {
+	exporter *Exporter
+
+	temperature            *prometheus.Desc
+	humidity               *prometheus.Desc
+	rawTemperature         *prometheus.Desc
+	rawHumidity            *prometheus.Desc
+	derived                map[string]*prometheus.Desc
+	batteryLow             *prometheus.Desc
+	lastSeen               *prometheus.Desc
+	sensorInfo             *prometheus.Desc
+	moldIndex              *prometheus.Desc
+	ventilationDifference  *prometheus.Desc
+	ventilationRecommended *prometheus.Desc
+	transmissionInterval   *prometheus.Desc
+	packetLoss             *prometheus.Desc
+	receptionQuality       *prometheus.Desc
+	unknownSensorInfo      *prometheus.Desc
+}
+
+func newSensorCollector(e *Exporter) *sensorCollector {
+	m := e.config.Metrics
+	newDesc := func(name, help string, labels []string) *prometheus.Desc {
+		return prometheus.NewDesc(m.metricName(name), help, labels, prometheus.Labels(m.Labels))
+	}
+	newSensorDesc := func(name, help string) *prometheus.Desc {
+		return newDesc(name, help, e.sensorLabels)
+	}
+	humidityUnit := humidityUnits[m.HumidityUnit]
+
+	return &sensorCollector{
+		exporter: e,
+
+		temperature: newSensorDesc("temperature_celsius",
+			"Current temperature in Celsius"),
+		humidity: newSensorDesc("humidity_"+m.HumidityUnit,
+			"Current humidity level "+humidityUnit),
+		rawTemperature: newSensorDesc("temperature_raw_celsius",
+			"Current temperature in Celsius as measured by the sensor (i.e. without calibration)"),
+		rawHumidity: newSensorDesc("humidity_raw_"+m.HumidityUnit,
+			"Current humidity level "+humidityUnit+" as measured by the sensor (i.e. without calibration)"),
+		derived: map[string]*prometheus.Desc{
+			DewPoint: newSensorDesc("dew_point_celsius",
+				"Current dew point in Celsius"),
+			AbsoluteHumidity: newSensorDesc("absolute_humidity_grams_per_cubic_meter",
+				"Current absolute humidity in g/m³"),
+			VaporPressureDeficit: newSensorDesc("vapor_pressure_deficit_pascals",
+				"Current vapor pressure deficit in Pa"),
+			HeatIndex: newSensorDesc("heat_index_celsius",
+				"Current heat index (apparent temperature) in Celsius"),
+		},
+		batteryLow: newSensorDesc("battery_low",
+			"Whether the battery of the sensor is low (1) or not (0)"),
+		lastSeen: newSensorDesc("last_seen_timestamp_seconds",
+			"Time when a signal of the sensor has been received last, in seconds since epoch"),
+		sensorInfo: newDesc("sensor_info",
+			"Information about the sensor, always 1",
+			append(e.sensorLabels[:len(e.sensorLabels):len(e.sensorLabels)], SensorProtocol, SensorChannel)),
+		moldIndex: newSensorDesc("mold_index",
+			"Current mold index from 0 (no growth) to 6 (heavy growth)"),
+		ventilationDifference: newSensorDesc("ventilation_absolute_humidity_difference_grams_per_cubic_meter",
+			"Difference between indoor and outdoor absolute humidity in g/m³"),
+		ventilationRecommended: newSensorDesc("ventilation_recommended",
+			"Whether opening the windows will dry the room (1) or not (0)"),
+		transmissionInterval: newSensorDesc("transmission_interval_seconds",
+			"Configured or learned time between two transmissions of the sensor"),
+		packetLoss: newSensorDesc("packet_loss_ratio",
+			"Estimated ratio of missed transmissions of the sensor since start"),
+		receptionQuality: newSensorDesc("reception_quality_ratio",
+			"Estimated ratio of received transmissions of the sensor within the recent "+
+				strconv.Itoa(recentGaps)+" gaps"),
+		unknownSensorInfo: newDesc("unknown_sensor_info",
+			"Sensor that has been received, but is not configured, always 1",
+			[]string{SensorProtocol, SensorID, SensorChannel}),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *sensorCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.temperature
+	ch <- c.humidity
+	ch <- c.rawTemperature
+	ch <- c.rawHumidity
+	for _, name := range derivedMetricNames() {
+		ch <- c.derived[name]
+	}
+	ch <- c.batteryLow
+	ch <- c.lastSeen
+	ch <- c.sensorInfo
+	ch <- c.moldIndex
+	ch <- c.ventilationDifference
+	ch <- c.ventilationRecommended
+	ch <- c.transmissionInterval
+	ch <- c.packetLoss
+	ch <- c.receptionQuality
+	ch <- c.unknownSensorInfo
+}
+
+// Collect implements prometheus.Collector. Values of sensors that have not
+// been received within their stale timeout are not collected, only the time
+// they have been seen last.
+func (c *sensorCollector) Collect(ch chan<- prometheus.Metric) {
+	e := c.exporter
+	now := time.Now()
+
+	for _, id := range e.config.SensorIDs() {
+		r := e.readings.Get(id)
+		if r == nil {
+			continue
+		}
+
+		labels := e.sensorLabelValues(r.Sensor)
+		ch <- prometheus.MustNewConstMetric(c.lastSeen, prometheus.GaugeValue,
+			float64(r.Time.UnixNano())/1e9, labels...)
+		ch <- prometheus.MustNewConstMetric(c.sensorInfo, prometheus.GaugeValue,
+			1, append(labels[:len(labels):len(labels)], r.Sensor.Protocol, strconv.Itoa(r.Channel))...)
+
+		if r.Stale(now) {
+			continue
+		}
+
+		c.collectReading(ch, r, labels)
+	}
+
+	for _, room := range ventilationSummary(e.config, e.readings, now).Rooms {
+		labels := e.sensorLabelValues(e.config.Sensors[room.ID])
+		c.collectSample(ch, c.ventilationDifference, room.Time, room.Difference, labels...)
+		c.collectSample(ch, c.ventilationRecommended, room.Time, boolToFloat(room.Recommended), labels...)
+	}
+
+	for _, s := range e.unknownSensors.All() {
+		ch <- prometheus.MustNewConstMetric(c.unknownSensorInfo, prometheus.GaugeValue,
+			1, s.Protocol, s.ID, strconv.Itoa(s.Channel))
+	}
+}
+
+func (c *sensorCollector) collectReading(ch chan<- prometheus.Metric, r *Reading, labels []string) {
+	e := c.exporter
+	m := e.config.Metrics
+
+	c.collectSample(ch, c.temperature, r.Time, r.Temperature, labels...)
+	c.collectSample(ch, c.humidity, r.Time, m.humidity(r.Humidity), labels...)
+	c.collectSample(ch, c.batteryLow, r.Time, boolToFloat(r.LowBattery), labels...)
+
+	if e.config.ExportRawValues {
+		c.collectSample(ch, c.rawTemperature, r.Time, r.RawTemperature, labels...)
+		c.collectSample(ch, c.rawHumidity, r.Time, m.humidity(r.RawHumidity), labels...)
+	}
+
+	for _, name := range e.config.DerivedMetrics {
+		v := derivations[name](r.Temperature, r.Humidity)
+		if !math.IsNaN(v) {
+			c.collectSample(ch, c.derived[name], r.Time, v, labels...)
+		}
+	}
+
+	if index, ok := e.moldRisk.Index(r.Sensor.ID); ok && r.Sensor.MoldRisk {
+		c.collectSample(ch, c.moldIndex, r.Time, index, labels...)
+	}
+
+	if stats, ok := e.intervals.Stats(r.Sensor.ID); ok {
+		c.collectSample(ch, c.transmissionInterval, r.Time, stats.Interval.Seconds(), labels...)
+		c.collectSample(ch, c.packetLoss, r.Time, stats.LossRatio, labels...)
+		c.collectSample(ch, c.receptionQuality, r.Time, stats.Quality, labels...)
+	}
+}
+
+// collectSample collects a gauge value, which has been received at time t.
+func (c *sensorCollector) collectSample(ch chan<- prometheus.Metric, desc *prometheus.Desc, t time.Time,
+	value float64, labelValues ...string) {
+	m := prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labelValues...)
+	if c.exporter.config.Metrics.Timestamps {
+		m = prometheus.NewMetricWithTimestamp(t, m)
+	}
+	ch <- m
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
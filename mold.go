@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+const (
+	// moldMaxStep limits the time between two readings that is taken into account,
+	// as conditions are unknown while a sensor is not received
+	moldMaxStep = time.Hour
+	// moldSaveInterval limits how often the state is written to disk
+	moldSaveInterval = 5 * time.Minute
+)
+
+// MoldState is the state of the mold model of a single sensor.
+type MoldState struct {
+	// Index is the mold index, ranging from 0 (no growth) to 6 (heavy growth)
+	Index float64 `json:"index"`
+	// Updated is the time of the last reading that updated the index
+	Updated time.Time `json:"updated"`
+	// UnfavourableSince is the start of the current period
+	// with conditions unfavourable for mold growth (zero if conditions are favourable)
+	UnfavourableSince time.Time `json:"unfavourable_since,omitempty"`
+}
+
+// MoldRisk tracks the mold index of sensors with the VTT model
+// (see: Hukka, Viitanen: A mathematical model of mould growth on wooden material, 1999),
+// assuming the most sensitive material (sawn pine sapwood).
+// The state is persisted in a file (if given), so that restarts don't reset it.
+type MoldRisk struct {
+	sync.Mutex
+	file   string
+	saved  time.Time
+	states map[string]*MoldState
+	// dirty is set if the state has changed since it has been saved
+	dirty bool
+}
+
+// NewMoldRisk creates a MoldRisk without any state, persisting it in file.
+func NewMoldRisk(file string) *MoldRisk {
+	return &MoldRisk{
+		file:   file,
+		states: map[string]*MoldState{},
+	}
+}
+
+// LoadMoldRisk creates a MoldRisk with the state persisted in file.
+// A missing file results in an empty state.
+func LoadMoldRisk(file string) (*MoldRisk, error) {
+	m := NewMoldRisk(file)
+	if file == "" {
+		return m, nil
+	}
+
+	data, err := afero.ReadFile(AppFs, file)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read mold risk state '%s'", file)
+	}
+
+	err = json.Unmarshal(data, &m.states)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse mold risk state '%s'", file)
+	}
+	return m, nil
+}
+
+// Update updates the mold index of the reading's sensor with the conditions
+// since its last reading and returns the new index.
+func (m *MoldRisk) Update(r *Reading) float64 {
+	m.Lock()
+	defer m.Unlock()
+
+	s, ok := m.states[r.Sensor.ID]
+	if !ok {
+		s = &MoldState{Updated: r.Time}
+		m.states[r.Sensor.ID] = s
+	}
+
+	step := r.Time.Sub(s.Updated)
+	if step > moldMaxStep {
+		step = moldMaxStep
+	}
+	if step > 0 {
+		s.update(r.Temperature, r.Humidity, r.Time, step)
+		s.Updated = r.Time
+	}
+	m.dirty = true
+
+	if r.Time.Sub(m.saved) >= moldSaveInterval {
+		if err := m.save(); err != nil {
+			log.Println(err)
+		}
+		m.saved = r.Time
+	}
+
+	return s.Index
+}
+
+// Index returns the current mold index of a sensor or false
+// if the sensor's index has not been tracked yet.
+func (m *MoldRisk) Index(id string) (float64, bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	s, ok := m.states[id]
+	if !ok {
+		return 0, false
+	}
+	return s.Index, true
+}
+
+// update changes the mold index according to the given conditions
+// measured at time t, which lasted for the given step.
+func (s *MoldState) update(temperature, humidity float64, t time.Time, step time.Duration) {
+	hours := step.Hours()
+
+	if moldFavourable(temperature, humidity) {
+		s.UnfavourableSince = time.Time{}
+		s.Index += moldGrowthRate(s.Index, temperature, humidity) * hours
+		return
+	}
+
+	if s.UnfavourableSince.IsZero() {
+		s.UnfavourableSince = t.Add(-step)
+	}
+
+	unfavourable := t.Sub(s.UnfavourableSince)
+	switch {
+	case unfavourable <= 6*time.Hour:
+		s.Index -= 0.00133 * hours
+	case unfavourable > 24*time.Hour:
+		s.Index -= 0.000667 * hours
+	}
+	s.Index = math.Max(s.Index, 0)
+}
+
+// moldCriticalHumidity returns the relative humidity in % above which mold can grow.
+func moldCriticalHumidity(temperature float64) float64 {
+	if temperature > 20 {
+		return 80
+	}
+	t := temperature
+	return -0.00267*t*t*t + 0.160*t*t - 3.13*t + 100
+}
+
+func moldFavourable(temperature, humidity float64) bool {
+	return temperature > 0 && temperature < 50 && humidity >= moldCriticalHumidity(temperature)
+}
+
+// moldGrowthRate returns the increase of the mold index per hour
+// under favourable conditions.
+func moldGrowthRate(index, temperature, humidity float64) float64 {
+	// time in weeks until growth starts and becomes visible
+	tm := math.Exp(-0.68*math.Log(temperature) - 13.9*math.Log(humidity) + 66.02)
+	tv := math.Exp(-0.74*math.Log(temperature) - 12.72*math.Log(humidity) + 61.5)
+
+	k1 := 1.0
+	if index >= 1 {
+		k1 = 2 / (tv/tm - 1)
+	}
+
+	rhCrit := moldCriticalHumidity(temperature)
+	x := (rhCrit - humidity) / (rhCrit - 100)
+	maxIndex := 1 + 7*x - 2*x*x
+	k2 := math.Max(1-math.Exp(2.3*(index-maxIndex)), 0)
+
+	perDay := k1 * k2 / (7 * tm)
+	return perDay / 24
+}
+
+// Flush writes the state to the file right away if it has changed since it has been saved.
+func (m *MoldRisk) Flush() error {
+	m.Lock()
+	defer m.Unlock()
+
+	if !m.dirty {
+		return nil
+	}
+	return m.save()
+}
+
+// save atomically writes the state to the file.
+func (m *MoldRisk) save() error {
+	if m.file == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(m.states)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(m.file, data); err != nil {
+		return err
+	}
+	m.dirty = false
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMoldCriticalHumidity(t *testing.T) {
+	assert.InDelta(t, 100, moldCriticalHumidity(0), 1e-9)
+	assert.InDelta(t, 80, moldCriticalHumidity(20), 0.1)
+	assert.Equal(t, 80.0, moldCriticalHumidity(25))
+}
+
+func TestMoldRisk_growsUnderFavourableConditions(t *testing.T) {
+	m := NewMoldRisk("")
+	s := &SensorConfig{ID: "91", Location: "basement"}
+
+	index := 0.0
+	for i := 0; i <= 14*24; i++ {
+		index = m.Update(&Reading{Sensor: s, Temperature: 20, Humidity: 97, Time: testTime.Add(time.Duration(i) * time.Hour)})
+	}
+
+	assert.True(t, index > 1, "Mold starts growing within two weeks at 97%%, got %v", index)
+	assert.True(t, index < 3, "Mold is not visible yet after two weeks at 97%%, got %v", index)
+}
+
+func TestMoldRisk_declinesUnderUnfavourableConditions(t *testing.T) {
+	m := NewMoldRisk("")
+	s := &SensorConfig{ID: "91", Location: "basement"}
+	m.states["91"] = &MoldState{Index: 1, Updated: testTime}
+
+	index := m.Update(&Reading{Sensor: s, Temperature: 20, Humidity: 50, Time: testTime.Add(time.Hour)})
+	assert.InDelta(t, 1-0.00133, index, 1e-9)
+
+	for i := 2; i <= 12; i++ {
+		index = m.Update(&Reading{Sensor: s, Temperature: 20, Humidity: 50, Time: testTime.Add(time.Duration(i) * time.Hour)})
+	}
+	assert.InDelta(t, 1-6*0.00133, index, 1e-9, "No decline between 6 and 24 hours")
+}
+
+func TestMoldRisk_ignoresGapsBetweenReadings(t *testing.T) {
+	m := NewMoldRisk("")
+	s := &SensorConfig{ID: "91", Location: "basement"}
+	m.states["91"] = &MoldState{Index: 1, Updated: testTime}
+
+	index := m.Update(&Reading{Sensor: s, Temperature: 20, Humidity: 50, Time: testTime.Add(48 * time.Hour)})
+
+	assert.InDelta(t, 1-0.00133, index, 1e-9)
+}
+
+func TestMoldRisk_persistsState(t *testing.T) {
+	AppFs = afero.NewMemMapFs()
+	s := &SensorConfig{ID: "91", Location: "basement"}
+
+	m, err := LoadMoldRisk("/var/lib/mold.json")
+	require.NoError(t, err, "Missing state file results in empty state")
+	m.states["91"] = &MoldState{Index: 2.5, Updated: testTime}
+	m.Update(&Reading{Sensor: s, Temperature: 20, Humidity: 50, Time: testTime.Add(time.Minute)})
+
+	m, err = LoadMoldRisk("/var/lib/mold.json")
+	require.NoError(t, err)
+	require.NotNil(t, m.states["91"])
+	assert.InDelta(t, 2.5, m.states["91"].Index, 0.001)
+	assert.True(t, testTime.Add(time.Minute).Equal(m.states["91"].Updated))
+
+	files, _ := afero.ReadDir(AppFs, "/var/lib")
+	assert.Len(t, files, 1, "No temporary files are left behind")
+}
+
+func TestMoldRisk_Flush(t *testing.T) {
+	AppFs = afero.NewMemMapFs()
+	s := &SensorConfig{ID: "91", Location: "basement"}
+
+	m, err := LoadMoldRisk("/var/lib/mold.json")
+	require.NoError(t, err)
+	m.Update(&Reading{Sensor: s, Temperature: 20, Humidity: 50, Time: testTime})
+	m.Update(&Reading{Sensor: s, Temperature: 20, Humidity: 50, Time: testTime.Add(time.Minute)})
+	require.NoError(t, m.Flush())
+
+	m, err = LoadMoldRisk("/var/lib/mold.json")
+	require.NoError(t, err)
+	require.NotNil(t, m.states["91"])
+	assert.True(t, testTime.Add(time.Minute).Equal(m.states["91"].Updated),
+		"Saved although the save interval has not passed")
+}
+
+func TestLoadMoldRisk_invalidState(t *testing.T) {
+	AppFs = afero.NewMemMapFs()
+	afero.WriteFile(AppFs, "/var/lib/mold.json", []byte("{"), 0644)
+
+	_, err := LoadMoldRisk("/var/lib/mold.json")
+
+	assert.Error(t, err)
+}
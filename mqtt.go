@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+)
+
+const (
+	// mqttOnline and mqttOffline are the payloads of the availability topic
+	mqttOnline  = "online"
+	mqttOffline = "offline"
+	// mqttConnectRetry is the time between two attempts to connect initially,
+	// the client reconnects by itself afterwards
+	mqttConnectRetry = 10 * time.Second
+)
+
+// MQTTConfig configures publishing readings to an MQTT broker.
+type MQTTConfig struct {
+	// Broker is the URL of the broker, e.g. tcp://localhost:1883 (publishing is disabled if not set)
+	Broker   string `mapstructure:"broker"`
+	ClientID string `mapstructure:"client_id"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	// TopicPrefix is the first level of all topics
+	TopicPrefix string `mapstructure:"topic_prefix"`
+	QoS         int    `mapstructure:"qos"`
+	// Retain makes the broker keep the latest reading of each sensor for new subscribers
+	Retain bool `mapstructure:"retain"`
+	// Timeout is the time to wait for a reading to be published
+	Timeout       time.Duration       `mapstructure:"timeout"`
+	HomeAssistant HomeAssistantConfig `mapstructure:"home_assistant"`
+}
+
+// HomeAssistantConfig configures the MQTT discovery of Home Assistant.
+type HomeAssistantConfig struct {
+	// Discovery publishes the configured sensors, so that they show up in Home Assistant
+	Discovery       bool   `mapstructure:"discovery"`
+	DiscoveryPrefix string `mapstructure:"discovery_prefix"`
+}
+
+func (m MQTTConfig) validate() ValidationErrors {
+	var errs ValidationErrors
+	if m.Broker == "" {
+		return errs
+	}
+
+	u, err := url.Parse(m.Broker)
+	if err != nil || u.Host == "" {
+		errs = append(errs, fmt.Errorf("mqtt: invalid broker %q", m.Broker))
+	} else {
+		switch u.Scheme {
+		case "tcp", "ssl", "tls", "ws", "wss":
+		default:
+			errs = append(errs, fmt.Errorf("mqtt: invalid broker %q (supported schemes: tcp, ssl, tls, ws, wss)",
+				m.Broker))
+		}
+	}
+	if m.ClientID == "" {
+		errs = append(errs, fmt.Errorf("mqtt: client id must not be empty"))
+	}
+	if !mqttTopicSafe(m.TopicPrefix) {
+		errs = append(errs, fmt.Errorf("mqtt: invalid topic prefix %q", m.TopicPrefix))
+	}
+	if m.QoS < 0 || m.QoS > 2 {
+		errs = append(errs, fmt.Errorf("mqtt: qos must be 0, 1 or 2, got %d", m.QoS))
+	}
+	if m.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("mqtt: timeout must be positive, got %v", m.Timeout))
+	}
+	if m.HomeAssistant.Discovery && !mqttTopicSafe(m.HomeAssistant.DiscoveryPrefix) {
+		errs = append(errs, fmt.Errorf("mqtt: invalid home assistant discovery prefix %q",
+			m.HomeAssistant.DiscoveryPrefix))
+	}
+	return errs
+}
+
+// mqttTopicSafe checks whether s can be used as part of a topic name.
+func mqttTopicSafe(s string) bool {
+	return s != "" && !strings.ContainsAny(s, "+#\x00") && labelSafe(s)
+}
+
+// mqttPublisher is the part of the MQTT client used to publish messages.
+type mqttPublisher interface {
+	Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token
+}
+
+// mqttOutput publishes readings as JSON to <prefix>/<id>/state and each
+// quantity to its own topic, e.g. <prefix>/<id>/temperature. Whether the
+// exporter is receiving is published to <prefix>/status.
+type mqttOutput struct {
+	config    MQTTConfig
+	sensors   []*SensorConfig
+	publisher mqttPublisher
+	client    mqtt.Client
+}
+
+// mqttState is the JSON payload of the state topic of a sensor.
+type mqttState struct {
+	ID          string    `json:"id"`
+	Location    string    `json:"location"`
+	Temperature float64   `json:"temperature"`
+	Humidity    float64   `json:"humidity"`
+	LowBattery  bool      `json:"low_battery"`
+	Time        time.Time `json:"time"`
+}
+
+func newMQTTOutput(c *Config) *mqttOutput {
+	o := &mqttOutput{config: c.MQTT}
+	for _, id := range c.SensorIDs() {
+		o.sensors = append(o.sensors, c.Sensors[id])
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(c.MQTT.Broker).
+		SetClientID(c.MQTT.ClientID).
+		SetUsername(c.MQTT.Username).
+		SetPassword(c.MQTT.Password).
+		SetAutoReconnect(true).
+		SetWill(o.availabilityTopic(), mqttOffline, byte(c.MQTT.QoS), true).
+		SetOnConnectHandler(func(mqtt.Client) {
+			log.Printf("Connected to MQTT broker '%v'", c.MQTT.Broker)
+			o.publishAvailability(mqttOnline)
+			if c.MQTT.HomeAssistant.Discovery {
+				o.publishDiscovery()
+			}
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Printf("Lost connection to MQTT broker '%v': %v", c.MQTT.Broker, err)
+		})
+
+	o.client = mqtt.NewClient(opts)
+	o.publisher = o.client
+	return o
+}
+
+// connect connects to the broker, retrying until it succeeds or ctx is done.
+func (o *mqttOutput) connect(ctx context.Context) {
+	for {
+		token := o.client.Connect()
+		token.Wait()
+		if token.Error() == nil {
+			return
+		}
+		log.Printf("Failed to connect to MQTT broker '%v': %v", o.config.Broker, token.Error())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(mqttConnectRetry):
+		}
+	}
+}
+
+// close marks the exporter as offline and disconnects from the broker.
+func (o *mqttOutput) close() {
+	if !o.client.IsConnected() {
+		return
+	}
+	o.publishAvailability(mqttOffline).WaitTimeout(time.Second)
+	o.client.Disconnect(250)
+}
+
+// Name identifies the MQTT output as sink.
+func (o *mqttOutput) Name() string {
+	return "mqtt"
+}
+
+// Write publishes the reading of a configured sensor and waits until it has been sent,
+// which fails after the timeout, e.g. while the client is reconnecting.
+func (o *mqttOutput) Write(r *Reading) error {
+	state, err := json.Marshal(mqttState{
+		ID:          r.Sensor.ID,
+		Location:    r.Sensor.Location,
+		Temperature: r.Temperature,
+		Humidity:    r.Humidity,
+		LowBattery:  r.LowBattery,
+		Time:        r.Time,
+	})
+	if err != nil {
+		return permanentError{err}
+	}
+
+	messages := []struct {
+		topic   string
+		payload interface{}
+	}{
+		{o.sensorTopic(r.Sensor, "state"), state},
+		{o.sensorTopic(r.Sensor, "temperature"), formatFloat(r.Temperature)},
+		{o.sensorTopic(r.Sensor, "humidity"), formatFloat(r.Humidity)},
+		{o.sensorTopic(r.Sensor, "low_battery"), strconv.FormatBool(r.LowBattery)},
+	}
+	for _, m := range messages {
+		token := o.publisher.Publish(m.topic, byte(o.config.QoS), o.config.Retain, m.payload)
+		if !token.WaitTimeout(o.config.Timeout) {
+			return errors.Errorf("Failed to publish to MQTT topic '%s': timed out after %v", m.topic, o.config.Timeout)
+		}
+		if token.Error() != nil {
+			return errors.Wrapf(token.Error(), "Failed to publish to MQTT topic '%s'", m.topic)
+		}
+	}
+	return nil
+}
+
+func (o *mqttOutput) publishAvailability(payload string) mqtt.Token {
+	return o.publish(o.availabilityTopic(), true, payload)
+}
+
+// publish sends a message without waiting for it to be delivered.
+func (o *mqttOutput) publish(topic string, retained bool, payload interface{}) mqtt.Token {
+	token := o.publisher.Publish(topic, byte(o.config.QoS), retained, payload)
+	go func() {
+		if token.Wait() && token.Error() != nil {
+			log.Printf("Failed to publish to MQTT topic '%v': %v", topic, token.Error())
+		}
+	}()
+	return token
+}
+
+func (o *mqttOutput) availabilityTopic() string {
+	return o.config.TopicPrefix + "/status"
+}
+
+func (o *mqttOutput) sensorTopic(s *SensorConfig, name string) string {
+	return o.config.TopicPrefix + "/" + s.ID + "/" + name
+}
+
+// homeAssistantEntity is the discovery config of a Home Assistant entity
+// (see: https://www.home-assistant.io/docs/mqtt/discovery/).
+type homeAssistantEntity struct {
+	Name              string              `json:"name"`
+	UniqueID          string              `json:"unique_id"`
+	StateTopic        string              `json:"state_topic"`
+	ValueTemplate     string              `json:"value_template"`
+	DeviceClass       string              `json:"device_class"`
+	StateClass        string              `json:"state_class,omitempty"`
+	UnitOfMeasurement string              `json:"unit_of_measurement,omitempty"`
+	AvailabilityTopic string              `json:"availability_topic"`
+	ExpireAfter       int                 `json:"expire_after"`
+	Device            homeAssistantDevice `json:"device"`
+}
+
+type homeAssistantDevice struct {
+	Identifiers []string `json:"identifiers"`
+	Name        string   `json:"name"`
+	Model       string   `json:"model"`
+}
+
+// publishDiscovery publishes the discovery configs of the temperature,
+// humidity and battery entities of all configured sensors.
+func (o *mqttOutput) publishDiscovery() {
+	for _, s := range o.sensors {
+		deviceID := sanitizeName(o.config.ClientID + "_" + s.ID)
+		device := homeAssistantDevice{
+			Identifiers: []string{deviceID},
+			Name:        s.Location,
+			Model:       s.Protocol,
+		}
+
+		entities := []struct {
+			component string
+			quantity  string
+			entity    homeAssistantEntity
+		}{
+			{"sensor", "temperature", homeAssistantEntity{
+				Name:              s.Location + " Temperature",
+				ValueTemplate:     "{{ value_json.temperature }}",
+				DeviceClass:       "temperature",
+				StateClass:        "measurement",
+				UnitOfMeasurement: "°C",
+			}},
+			{"sensor", "humidity", homeAssistantEntity{
+				Name:              s.Location + " Humidity",
+				ValueTemplate:     "{{ value_json.humidity }}",
+				DeviceClass:       "humidity",
+				StateClass:        "measurement",
+				UnitOfMeasurement: "%",
+			}},
+			{"binary_sensor", "battery", homeAssistantEntity{
+				Name:          s.Location + " Battery",
+				ValueTemplate: "{{ 'ON' if value_json.low_battery else 'OFF' }}",
+				DeviceClass:   "battery",
+			}},
+		}
+
+		for _, e := range entities {
+			objectID := deviceID + "_" + e.quantity
+			e.entity.UniqueID = objectID
+			e.entity.StateTopic = o.sensorTopic(s, "state")
+			e.entity.AvailabilityTopic = o.availabilityTopic()
+			e.entity.ExpireAfter = int(s.StaleTimeout.Seconds())
+			e.entity.Device = device
+
+			config, err := json.Marshal(e.entity)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			topic := o.config.HomeAssistant.DiscoveryPrefix + "/" + e.component + "/" + objectID + "/config"
+			o.publish(topic, true, config)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pendingToken is the token of a message that is never sent, e.g. while reconnecting.
+type pendingToken struct{}
+
+func (pendingToken) Wait() bool {
+	select {}
+}
+
+func (pendingToken) WaitTimeout(d time.Duration) bool {
+	time.Sleep(d)
+	return false
+}
+
+func (pendingToken) Error() error {
+	return nil
+}
+
+type pendingPublisher struct{}
+
+func (pendingPublisher) Publish(string, byte, bool, interface{}) mqtt.Token {
+	return pendingToken{}
+}
+
+type publishedMessage struct {
+	topic    string
+	retained bool
+	payload  string
+}
+
+// fakePublisher records all published messages instead of sending them to a broker.
+type fakePublisher struct {
+	sync.Mutex
+	messages []publishedMessage
+}
+
+func (p *fakePublisher) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	p.Lock()
+	defer p.Unlock()
+
+	var s string
+	switch v := payload.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	}
+	p.messages = append(p.messages, publishedMessage{topic, retained, s})
+	return &mqtt.DummyToken{}
+}
+
+func (p *fakePublisher) message(topic string) (publishedMessage, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	for _, m := range p.messages {
+		if m.topic == topic {
+			return m, true
+		}
+	}
+	return publishedMessage{}, false
+}
+
+func newTestMQTTOutput(t *testing.T) (*mqttOutput, *fakePublisher) {
+	c, err := parseConfigString(`
+mqtt:
+  broker: tcp://localhost:1883
+  home_assistant:
+    discovery: true
+sensors:
+  91:
+    location: fridge
+    protocol: weather12
+    stale_timeout: 5m
+`)
+	require.NoError(t, err)
+
+	o := newMQTTOutput(c)
+	p := &fakePublisher{}
+	o.publisher = p
+	return o, p
+}
+
+func TestMQTTOutput_Write(t *testing.T) {
+	o, p := newTestMQTTOutput(t)
+	s := o.sensors[0]
+
+	require.NoError(t, o.Write(&Reading{Sensor: s, Temperature: 4.2, Humidity: 60, LowBattery: true, Time: testTime}))
+
+	m, ok := p.message("weather-station/91/state")
+	require.True(t, ok)
+	assert.False(t, m.retained)
+	assert.JSONEq(t, `{"id":"91","location":"fridge","temperature":4.2,"humidity":60,"low_battery":true,`+
+		`"time":"2019-10-06T21:29:28Z"}`, m.payload)
+
+	m, _ = p.message("weather-station/91/temperature")
+	assert.Equal(t, "4.2", m.payload)
+	m, _ = p.message("weather-station/91/humidity")
+	assert.Equal(t, "60", m.payload)
+	m, _ = p.message("weather-station/91/low_battery")
+	assert.Equal(t, "true", m.payload)
+}
+
+func TestMQTTOutput_publishDiscovery(t *testing.T) {
+	o, p := newTestMQTTOutput(t)
+
+	o.publishDiscovery()
+
+	m, ok := p.message("homeassistant/sensor/weather-station_91_temperature/config")
+	require.True(t, ok)
+	assert.True(t, m.retained)
+
+	var entity homeAssistantEntity
+	require.NoError(t, json.Unmarshal([]byte(m.payload), &entity))
+	assert.Equal(t, homeAssistantEntity{
+		Name:              "fridge Temperature",
+		UniqueID:          "weather-station_91_temperature",
+		StateTopic:        "weather-station/91/state",
+		ValueTemplate:     "{{ value_json.temperature }}",
+		DeviceClass:       "temperature",
+		StateClass:        "measurement",
+		UnitOfMeasurement: "°C",
+		AvailabilityTopic: "weather-station/status",
+		ExpireAfter:       int((5 * time.Minute).Seconds()),
+		Device: homeAssistantDevice{
+			Identifiers: []string{"weather-station_91"},
+			Name:        "fridge",
+			Model:       "weather12",
+		},
+	}, entity)
+
+	_, ok = p.message("homeassistant/sensor/weather-station_91_humidity/config")
+	assert.True(t, ok)
+	_, ok = p.message("homeassistant/binary_sensor/weather-station_91_battery/config")
+	assert.True(t, ok)
+}
+
+func TestMQTTOutput_Write_timeout(t *testing.T) {
+	o, _ := newTestMQTTOutput(t)
+	o.config.Timeout = 10 * time.Millisecond
+	o.publisher = pendingPublisher{}
+
+	err := o.Write(&Reading{Sensor: o.sensors[0], Temperature: 4.2, Humidity: 60, Time: testTime})
+
+	assert.EqualError(t, err, "Failed to publish to MQTT topic 'weather-station/91/state': timed out after 10ms")
+}
+
+func TestParseConfig_invalidMQTT(t *testing.T) {
+	_, err := parseConfigString(`
+mqtt:
+  broker: http://localhost:1883
+  topic_prefix: home/+
+  qos: 3
+  timeout: 0s
+`)
+
+	assert.EqualError(t, err, `mqtt: invalid broker "http://localhost:1883" `+
+		`(supported schemes: tcp, ssl, tls, ws, wss); `+
+		`mqtt: invalid topic prefix "home/+"; `+
+		"mqtt: qos must be 0, 1 or 2, got 3; "+
+		"mqtt: timeout must be positive, got 0s")
+}
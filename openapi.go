@@ -0,0 +1,328 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+// openAPISpec describes the JSON API of the exporter in OpenAPI 3.0.
+const openAPISpec = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "weather-station",
+    "description": "Readings of the configured 433 MHz sensors received by the weather station.",
+    "version": "1"
+  },
+  "paths": {
+    "/api/sensors": {
+      "get": {
+        "summary": "List all configured sensors with their latest values",
+        "operationId": "listSensors",
+        "parameters": [
+          {"$ref": "#/components/parameters/IfNoneMatch"}
+        ],
+        "responses": {
+          "200": {
+            "description": "All configured sensors, sorted by id",
+            "headers": {"ETag": {"$ref": "#/components/headers/ETag"}},
+            "content": {
+              "application/json": {
+                "schema": {"type": "array", "items": {"$ref": "#/components/schemas/Sensor"}}
+              }
+            }
+          },
+          "304": {"description": "The sensors have not changed since the given ETag"}
+        }
+      }
+    },
+    "/api/sensors/{id}": {
+      "get": {
+        "summary": "Get a configured sensor with its latest values",
+        "operationId": "getSensor",
+        "parameters": [
+          {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"$ref": "#/components/parameters/IfNoneMatch"}
+        ],
+        "responses": {
+          "200": {
+            "description": "The sensor",
+            "headers": {"ETag": {"$ref": "#/components/headers/ETag"}},
+            "content": {
+              "application/json": {"schema": {"$ref": "#/components/schemas/Sensor"}}
+            }
+          },
+          "304": {"description": "The sensor has not changed since the given ETag"},
+          "404": {
+            "description": "The sensor is not configured",
+            "content": {
+              "application/json": {"schema": {"$ref": "#/components/schemas/Error"}}
+            }
+          }
+        }
+      }
+    },
+    "/api/stream": {
+      "get": {
+        "summary": "Stream events as Server-Sent Events or, if upgraded, as JSON messages of a WebSocket",
+        "description": "SSE events are named by type and have the data as JSON. WebSocket messages are objects with type and data.",
+        "operationId": "stream",
+        "parameters": [
+          {
+            "name": "events", "in": "query", "style": "form", "explode": false,
+            "description": "Types of events to send (default: reading)",
+            "schema": {"type": "array", "items": {"type": "string", "enum": ["reading", "signal", "unknown_sensor"]}}
+          },
+          {
+            "name": "sensor", "in": "query", "style": "form", "explode": false,
+            "description": "Only send readings and unknown sensors with these ids",
+            "schema": {"type": "array", "items": {"type": "string"}}
+          },
+          {
+            "name": "location", "in": "query", "style": "form", "explode": false,
+            "description": "Only send readings of sensors at these locations",
+            "schema": {"type": "array", "items": {"type": "string"}}
+          }
+        ],
+        "responses": {
+          "101": {"description": "Switched to WebSocket"},
+          "200": {
+            "description": "Stream of events: reading (Sensor), signal (Signal) and unknown_sensor (UnknownSensor)",
+            "content": {"text/event-stream": {"schema": {"type": "string"}}}
+          },
+          "400": {
+            "description": "Unknown event type",
+            "content": {
+              "application/json": {"schema": {"$ref": "#/components/schemas/Error"}}
+            }
+          }
+        }
+      }
+    },
+    "/api/history": {
+      "get": {
+        "summary": "Get the readings of a sensor kept in memory or, if configured, in the store, optionally downsampled",
+        "description": "Readings that have already been downsampled in the store are returned as the averages of their buckets.",
+        "operationId": "getHistory",
+        "parameters": [
+          {"name": "sensor", "in": "query", "required": true, "schema": {"type": "string"}},
+          {
+            "name": "from", "in": "query",
+            "description": "RFC 3339 time or Unix timestamp (default: start of the retention of the in-memory history)",
+            "schema": {"type": "string"}
+          },
+          {
+            "name": "to", "in": "query",
+            "description": "RFC 3339 time or Unix timestamp (default: now)",
+            "schema": {"type": "string"}
+          },
+          {
+            "name": "step", "in": "query",
+            "description": "Aggregate the readings into buckets of this duration, e.g. 5m (at least the step of the store, if configured)",
+            "schema": {"type": "string"}
+          },
+          {"$ref": "#/components/parameters/IfNoneMatch"}
+        ],
+        "responses": {
+          "200": {
+            "description": "The readings, or buckets if a step is given, oldest first",
+            "headers": {"ETag": {"$ref": "#/components/headers/ETag"}},
+            "content": {
+              "application/json": {"schema": {"$ref": "#/components/schemas/History"}}
+            }
+          },
+          "304": {"description": "The history has not changed since the given ETag"},
+          "400": {
+            "description": "Missing sensor or invalid time range or step",
+            "content": {
+              "application/json": {"schema": {"$ref": "#/components/schemas/Error"}}
+            }
+          },
+          "404": {
+            "description": "The sensor is not configured",
+            "content": {
+              "application/json": {"schema": {"$ref": "#/components/schemas/Error"}}
+            }
+          },
+          "500": {
+            "description": "The store could not be read",
+            "content": {
+              "application/json": {"schema": {"$ref": "#/components/schemas/Error"}}
+            }
+          }
+        }
+      }
+    },
+    "/api/ventilation": {
+      "get": {
+        "summary": "Compare the absolute humidity of indoor sensors with the outdoor sensor",
+        "operationId": "getVentilation",
+        "responses": {
+          "200": {
+            "description": "Ventilation advice for all rooms",
+            "content": {
+              "application/json": {"schema": {"$ref": "#/components/schemas/Ventilation"}}
+            }
+          }
+        }
+      }
+    },
+    "/api/unknown-sensors": {
+      "get": {
+        "summary": "List received sensors that are not configured",
+        "operationId": "listUnknownSensors",
+        "responses": {
+          "200": {
+            "description": "All unknown sensors",
+            "content": {
+              "application/json": {
+                "schema": {"type": "array", "items": {"$ref": "#/components/schemas/UnknownSensor"}}
+              }
+            }
+          }
+        }
+      }
+    }
+  },
+  "components": {
+    "parameters": {
+      "IfNoneMatch": {
+        "name": "If-None-Match",
+        "in": "header",
+        "description": "ETag of a previous response, which is not sent again if nothing has changed",
+        "schema": {"type": "string"}
+      }
+    },
+    "headers": {
+      "ETag": {"description": "Version of the response", "schema": {"type": "string"}}
+    },
+    "schemas": {
+      "Sensor": {
+        "type": "object",
+        "required": ["id", "location", "protocol", "channel", "temperature", "humidity",
+          "low_battery", "last_seen", "stale"],
+        "properties": {
+          "id": {"type": "string"},
+          "location": {"type": "string"},
+          "protocol": {"type": "string"},
+          "placement": {"type": "string", "enum": ["indoor", "outdoor"]},
+          "labels": {"type": "object", "additionalProperties": {"type": "string"}},
+          "channel": {"type": "integer", "nullable": true},
+          "temperature": {"type": "number", "nullable": true, "description": "Calibrated temperature in °C"},
+          "humidity": {"type": "number", "nullable": true, "description": "Calibrated relative humidity in %"},
+          "low_battery": {"type": "boolean", "nullable": true},
+          "last_seen": {"type": "string", "format": "date-time", "nullable": true},
+          "stale": {"type": "boolean", "description": "Not received within the stale timeout"}
+        }
+      },
+      "History": {
+        "type": "object",
+        "properties": {
+          "sensor": {"type": "string"},
+          "location": {"type": "string"},
+          "from": {"type": "string", "format": "date-time"},
+          "to": {"type": "string", "format": "date-time"},
+          "step": {"type": "string", "description": "Only set if downsampled"},
+          "points": {
+            "type": "array",
+            "items": {
+              "oneOf": [
+                {"$ref": "#/components/schemas/HistoryPoint"},
+                {"$ref": "#/components/schemas/HistoryBucket"}
+              ]
+            }
+          }
+        }
+      },
+      "HistoryPoint": {
+        "type": "object",
+        "properties": {
+          "time": {"type": "string", "format": "date-time"},
+          "temperature": {"type": "number"},
+          "humidity": {"type": "number"}
+        }
+      },
+      "HistoryBucket": {
+        "type": "object",
+        "properties": {
+          "time": {"type": "string", "format": "date-time", "description": "Start of the bucket"},
+          "count": {"type": "integer"},
+          "temperature": {"$ref": "#/components/schemas/Aggregate"},
+          "humidity": {"$ref": "#/components/schemas/Aggregate"}
+        }
+      },
+      "Aggregate": {
+        "type": "object",
+        "properties": {
+          "min": {"type": "number"},
+          "max": {"type": "number"},
+          "avg": {"type": "number"}
+        }
+      },
+      "AbsoluteHumidity": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "location": {"type": "string"},
+          "absolute_humidity": {"type": "number", "description": "Absolute humidity in g/m³"},
+          "time": {"type": "string", "format": "date-time"}
+        }
+      },
+      "Ventilation": {
+        "type": "object",
+        "properties": {
+          "outdoor": {"allOf": [{"$ref": "#/components/schemas/AbsoluteHumidity"}], "nullable": true},
+          "rooms": {
+            "type": "array",
+            "nullable": true,
+            "items": {
+              "allOf": [
+                {"$ref": "#/components/schemas/AbsoluteHumidity"},
+                {
+                  "type": "object",
+                  "properties": {
+                    "difference": {"type": "number", "description": "Indoor minus outdoor absolute humidity in g/m³"},
+                    "recommended": {"type": "boolean"}
+                  }
+                }
+              ]
+            }
+          }
+        }
+      },
+      "UnknownSensor": {
+        "type": "object",
+        "properties": {
+          "protocol": {"type": "string"},
+          "id": {"type": "string"},
+          "channel": {"type": "integer"},
+          "first_seen": {"type": "string", "format": "date-time"},
+          "last_seen": {"type": "string", "format": "date-time"},
+          "count": {"type": "integer"},
+          "temperature": {"type": "number"},
+          "humidity": {"type": "integer"},
+          "low_battery": {"type": "boolean"}
+        }
+      },
+      "Signal": {
+        "type": "object",
+        "properties": {
+          "signal": {"type": "string", "description": "Compressed signal as read from the Arduino"},
+          "time": {"type": "string", "format": "date-time"}
+        }
+      },
+      "Error": {
+        "type": "object",
+        "properties": {"error": {"type": "string"}}
+      }
+    }
+  }
+}
+`
+
+// openAPIHandler serves the OpenAPI description of the API.
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write([]byte(openAPISpec)); err != nil {
+		log.Println(err)
+	}
+}
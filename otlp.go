@@ -0,0 +1,561 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/net/http2"
+)
+
+// The protocols of OTLP, named like the values of OTEL_EXPORTER_OTLP_PROTOCOL.
+const (
+	OTLPHTTPProtobuf = "http/protobuf"
+	OTLPHTTPJSON     = "http/json"
+	OTLPGRPC         = "grpc"
+)
+
+const (
+	// otlpMetricsPath is appended to the endpoint of the HTTP protocols if it has no path
+	otlpMetricsPath = "/v1/metrics"
+	// otlpExportMethod is the path of the gRPC method exporting metrics
+	otlpExportMethod = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+	// otlpScopeName is the name of the instrumentation scope of all metrics
+	otlpScopeName = "weather-station"
+)
+
+// OTLPConfig configures periodically exporting the metrics of the sensors
+// and the receiver via the OpenTelemetry protocol, e.g. to a collector.
+type OTLPConfig struct {
+	// Endpoint is the URL of the receiver, e.g. http://localhost:4318 for the HTTP
+	// protocols or http://localhost:4317 for gRPC (exporting is disabled if not set)
+	Endpoint string `mapstructure:"endpoint"`
+	// Protocol is one of http/protobuf, http/json or grpc
+	Protocol string `mapstructure:"protocol"`
+	// Headers are sent with every request, e.g. for authentication
+	Headers map[string]string `mapstructure:"headers"`
+	// ResourceAttributes are added to the resource attributes service.name,
+	// host.name and weather_station.device, which they can override. Names
+	// containing dots are nested maps in YAML, as viper splits keys on dots.
+	ResourceAttributes map[string]interface{} `mapstructure:"resource_attributes"`
+	// Interval is the time between two exports
+	Interval time.Duration `mapstructure:"interval"`
+	// Timeout limits the time of a single request
+	Timeout time.Duration `mapstructure:"timeout"`
+	// Retries is the number of times a failed request is retried, after 1s and twice as long before every further retry
+	Retries int `mapstructure:"retries"`
+	// Device is the path of the Arduino, which is set from the command line
+	Device string `mapstructure:"-"`
+}
+
+func (o OTLPConfig) validate() ValidationErrors {
+	var errs ValidationErrors
+	if o.Endpoint == "" {
+		return errs
+	}
+
+	if err := validateURL(o.Endpoint); err != nil {
+		errs = append(errs, fmt.Errorf("otlp: %v", err))
+	}
+	switch o.Protocol {
+	case OTLPHTTPProtobuf, OTLPHTTPJSON, OTLPGRPC:
+	default:
+		errs = append(errs, fmt.Errorf("otlp: invalid protocol %q (supported: %s, %s, %s)",
+			o.Protocol, OTLPHTTPProtobuf, OTLPHTTPJSON, OTLPGRPC))
+	}
+	if o.Interval <= 0 {
+		errs = append(errs, fmt.Errorf("otlp: interval must be positive, got %v", o.Interval))
+	}
+	if o.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("otlp: timeout must be positive, got %v", o.Timeout))
+	}
+	if o.Retries < 0 {
+		errs = append(errs, fmt.Errorf("otlp: retries must not be negative, got %d", o.Retries))
+	}
+	if _, err := flattenAttributes("", o.ResourceAttributes); err != nil {
+		errs = append(errs, fmt.Errorf("otlp: %v", err))
+	}
+	return errs
+}
+
+// flattenAttributes joins the names of nested attributes with dots
+// and converts their values to strings.
+func flattenAttributes(prefix string, attributes map[string]interface{}) (map[string]string, error) {
+	flat := map[string]string{}
+	for name, value := range attributes {
+		name = prefix + name
+		switch v := value.(type) {
+		case map[string]interface{}:
+			nested, err := flattenAttributes(name+".", v)
+			if err != nil {
+				return nil, err
+			}
+			for n, v := range nested {
+				flat[n] = v
+			}
+		case string, bool, int, int64, float64:
+			flat[name] = fmt.Sprint(v)
+		default:
+			return nil, fmt.Errorf("resource attribute %s must be a string, number or boolean", name)
+		}
+	}
+	return flat, nil
+}
+
+// otlpOutput exports snapshots of metrics as OTLP metrics. Gauges and untyped
+// metrics become gauges, counters become cumulative sums and histograms and
+// summaries keep their type.
+type otlpOutput struct {
+	config   OTLPConfig
+	gatherer prometheus.Gatherer
+	client   *http.Client
+	// start is the start time of all cumulative metrics
+	start time.Time
+	// backoff is the delay before the first retry, which doubles with every retry
+	backoff time.Duration
+}
+
+func newOTLPOutput(c OTLPConfig, g prometheus.Gatherer, start time.Time) *otlpOutput {
+	client := &http.Client{Timeout: c.Timeout}
+	if c.Protocol == OTLPGRPC {
+		t := &http2.Transport{}
+		if strings.HasPrefix(c.Endpoint, "http://") {
+			// gRPC without TLS requires HTTP/2 with prior knowledge
+			t.AllowHTTP = true
+			t.DialTLS = func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return net.DialTimeout(network, addr, c.Timeout)
+			}
+		}
+		client.Transport = t
+	}
+
+	return &otlpOutput{
+		config:   c,
+		gatherer: g,
+		client:   client,
+		start:    start,
+		backoff:  time.Second,
+	}
+}
+
+func (o *otlpOutput) run(ctx context.Context) {
+	ticker := time.NewTicker(o.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := o.export(now); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// export sends the current metrics and retries it with exponential backoff, unless it is rejected.
+// Metrics without a timestamp get the given time.
+func (o *otlpOutput) export(now time.Time) error {
+	families, err := o.gatherer.Gather()
+	if err != nil {
+		return errors.Wrap(err, "Failed to gather metrics")
+	}
+
+	req := &otlpExportRequest{
+		ResourceMetrics: []*otlpResourceMetrics{{
+			Resource: o.resource(),
+			ScopeMetrics: []*otlpScopeMetrics{{
+				Scope:   &otlpScope{Name: otlpScopeName},
+				Metrics: otlpMetrics(families, o.start, now),
+			}},
+		}},
+	}
+
+	var data []byte
+	if o.config.Protocol == OTLPHTTPJSON {
+		data, err = json.Marshal(req)
+	} else {
+		data, err = proto.Marshal(req)
+	}
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode OTLP request")
+	}
+
+	return retry(o.config.Retries, o.backoff, func() error {
+		if o.config.Protocol == OTLPGRPC {
+			return o.postGRPC(data)
+		}
+		return o.postHTTP(data)
+	})
+}
+
+// resource returns the resource of the exporter with the configured attributes.
+func (o *otlpOutput) resource() *otlpResource {
+	attributes := map[string]string{"service.name": "weather-station"}
+	if host, err := os.Hostname(); err == nil {
+		attributes["host.name"] = host
+	}
+	if o.config.Device != "" {
+		attributes["weather_station.device"] = o.config.Device
+	}
+	configured, _ := flattenAttributes("", o.config.ResourceAttributes)
+	for name, value := range configured {
+		attributes[name] = value
+	}
+
+	r := &otlpResource{}
+	for _, name := range sortedKeys(attributes) {
+		r.Attributes = append(r.Attributes, newOTLPKeyValue(name, attributes[name]))
+	}
+	return r
+}
+
+func (o *otlpOutput) postHTTP(data []byte) error {
+	endpoint := o.config.Endpoint
+	if u, err := url.Parse(endpoint); err == nil && (u.Path == "" || u.Path == "/") {
+		endpoint = strings.TrimSuffix(endpoint, "/") + otlpMetricsPath
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return permanentError{errors.Wrapf(err, "Failed to export to '%s'", endpoint)}
+	}
+	if o.config.Protocol == OTLPHTTPJSON {
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req.Header.Set("Content-Type", "application/x-protobuf")
+	}
+	for name, value := range o.config.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to export to '%s'", endpoint)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	err = errors.Errorf("Failed to export to '%s': %s: %s", endpoint, resp.Status, bytes.TrimSpace(body))
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return err
+	}
+	return permanentError{err}
+}
+
+// otlpRetryableCodes are the gRPC status codes after which a request can be retried.
+var otlpRetryableCodes = map[string]bool{
+	"1":  true, // CANCELLED
+	"4":  true, // DEADLINE_EXCEEDED
+	"8":  true, // RESOURCE_EXHAUSTED
+	"10": true, // ABORTED
+	"11": true, // OUT_OF_RANGE
+	"14": true, // UNAVAILABLE
+	"15": true, // DATA_LOSS
+}
+
+func (o *otlpOutput) postGRPC(data []byte) error {
+	endpoint := strings.TrimSuffix(o.config.Endpoint, "/") + otlpExportMethod
+
+	// a gRPC message is prefixed by an uncompressed flag and its length
+	msg := make([]byte, 5+len(data))
+	binary.BigEndian.PutUint32(msg[1:5], uint32(len(data)))
+	copy(msg[5:], data)
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(msg))
+	if err != nil {
+		return permanentError{errors.Wrapf(err, "Failed to export to '%s'", o.config.Endpoint)}
+	}
+	for name, value := range o.config.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Type", "application/grpc+proto")
+	req.Header.Set("TE", "trailers")
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to export to '%s'", o.config.Endpoint)
+	}
+	defer resp.Body.Close()
+
+	// the status is sent as trailer, which is available once the body has been read
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("Failed to export to '%s': %s", o.config.Endpoint, resp.Status)
+	}
+	status, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		// responses without a message may only consist of headers
+		status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if status == "0" {
+		return nil
+	}
+
+	if unescaped, err := url.PathUnescape(message); err == nil {
+		message = unescaped
+	}
+	err = errors.Errorf("Failed to export to '%s': gRPC status %s: %s", o.config.Endpoint, status, message)
+	if otlpRetryableCodes[status] {
+		return err
+	}
+	return permanentError{err}
+}
+
+// otlpMetrics converts metric families into OTLP metrics.
+func otlpMetrics(families []*dto.MetricFamily, start, now time.Time) []*otlpMetric {
+	startNano := uint64(start.UnixNano())
+
+	var metrics []*otlpMetric
+	for _, f := range families {
+		metric := &otlpMetric{Name: f.GetName(), Description: f.GetHelp()}
+		switch f.GetType() {
+		case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+			metric.Gauge = &otlpGauge{}
+		case dto.MetricType_COUNTER:
+			metric.Sum = &otlpSum{AggregationTemporality: otlpCumulative, IsMonotonic: true}
+		case dto.MetricType_HISTOGRAM:
+			metric.Histogram = &otlpHistogram{AggregationTemporality: otlpCumulative}
+		case dto.MetricType_SUMMARY:
+			metric.Summary = &otlpSummary{}
+		default:
+			continue
+		}
+
+		for _, m := range f.GetMetric() {
+			t := uint64(now.UnixNano())
+			if m.TimestampMs != nil {
+				t = uint64(m.GetTimestampMs()) * uint64(time.Millisecond)
+			}
+			var attributes []*otlpKeyValue
+			for _, l := range m.GetLabel() {
+				attributes = append(attributes, newOTLPKeyValue(l.GetName(), l.GetValue()))
+			}
+
+			switch {
+			case metric.Gauge != nil:
+				value := m.GetGauge().GetValue()
+				if f.GetType() == dto.MetricType_UNTYPED {
+					value = m.GetUntyped().GetValue()
+				}
+				if math.IsNaN(value) {
+					// a missing value is expressed by omitting the data point
+					continue
+				}
+				metric.Gauge.DataPoints = append(metric.Gauge.DataPoints, &otlpNumberDataPoint{
+					Attributes:   attributes,
+					TimeUnixNano: t,
+					AsDouble:     &value,
+				})
+			case metric.Sum != nil:
+				value := m.GetCounter().GetValue()
+				metric.Sum.DataPoints = append(metric.Sum.DataPoints, &otlpNumberDataPoint{
+					Attributes:        attributes,
+					StartTimeUnixNano: startNano,
+					TimeUnixNano:      t,
+					AsDouble:          &value,
+				})
+			case metric.Histogram != nil:
+				h := m.GetHistogram()
+				sum := h.GetSampleSum()
+				p := &otlpHistogramDataPoint{
+					Attributes:        attributes,
+					StartTimeUnixNano: startNano,
+					TimeUnixNano:      t,
+					Count:             h.GetSampleCount(),
+					Sum:               &sum,
+				}
+				// Prometheus buckets are cumulative, OTLP buckets are not
+				var previous uint64
+				for _, b := range h.GetBucket() {
+					if math.IsInf(b.GetUpperBound(), +1) {
+						continue
+					}
+					p.ExplicitBounds = append(p.ExplicitBounds, b.GetUpperBound())
+					p.BucketCounts = append(p.BucketCounts, b.GetCumulativeCount()-previous)
+					previous = b.GetCumulativeCount()
+				}
+				p.BucketCounts = append(p.BucketCounts, h.GetSampleCount()-previous)
+				metric.Histogram.DataPoints = append(metric.Histogram.DataPoints, p)
+			case metric.Summary != nil:
+				s := m.GetSummary()
+				p := &otlpSummaryDataPoint{
+					Attributes:        attributes,
+					StartTimeUnixNano: startNano,
+					TimeUnixNano:      t,
+					Count:             s.GetSampleCount(),
+					Sum:               s.GetSampleSum(),
+				}
+				for _, q := range s.GetQuantile() {
+					p.QuantileValues = append(p.QuantileValues,
+						&otlpValueAtQuantile{Quantile: q.GetQuantile(), Value: q.GetValue()})
+				}
+				metric.Summary.DataPoints = append(metric.Summary.DataPoints, p)
+			}
+		}
+		metrics = append(metrics, metric)
+	}
+
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].Name < metrics[j].Name
+	})
+	return metrics
+}
+
+func newOTLPKeyValue(key, value string) *otlpKeyValue {
+	return &otlpKeyValue{Key: key, Value: &otlpAnyValue{StringValue: &value}}
+}
+
+// otlpCumulative is the aggregation temporality of metrics that
+// accumulate since the start time, like Prometheus counters.
+const otlpCumulative = 2
+
+// The messages of OTLP (see opentelemetry/proto/collector/metrics/v1 and metrics/v1),
+// declared here as the generated packages depend on a newer protobuf and gRPC.
+// Fields of oneofs are pointers, so that zero values are still sent. The JSON
+// names and the encoding of 64-bit integers as strings follow OTLP/JSON.
+
+type otlpExportRequest struct {
+	ResourceMetrics []*otlpResourceMetrics `protobuf:"bytes,1,rep,name=resource_metrics,proto3" json:"resourceMetrics"`
+}
+
+func (m *otlpExportRequest) Reset()         { *m = otlpExportRequest{} }
+func (m *otlpExportRequest) String() string { return proto.CompactTextString(m) }
+func (*otlpExportRequest) ProtoMessage()    {}
+
+type otlpResourceMetrics struct {
+	Resource     *otlpResource       `protobuf:"bytes,1,opt,name=resource,proto3" json:"resource"`
+	ScopeMetrics []*otlpScopeMetrics `protobuf:"bytes,2,rep,name=scope_metrics,proto3" json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []*otlpKeyValue `protobuf:"bytes,1,rep,name=attributes,proto3" json:"attributes"`
+}
+
+type otlpKeyValue struct {
+	Key   string        `protobuf:"bytes,1,opt,name=key,proto3" json:"key"`
+	Value *otlpAnyValue `protobuf:"bytes,2,opt,name=value,proto3" json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string `protobuf:"bytes,1,opt,name=string_value" json:"stringValue,omitempty"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   *otlpScope    `protobuf:"bytes,1,opt,name=scope,proto3" json:"scope"`
+	Metrics []*otlpMetric `protobuf:"bytes,2,rep,name=metrics,proto3" json:"metrics"`
+}
+
+type otlpScope struct {
+	Name string `protobuf:"bytes,1,opt,name=name,proto3" json:"name"`
+}
+
+type otlpMetric struct {
+	Name        string         `protobuf:"bytes,1,opt,name=name,proto3" json:"name"`
+	Description string         `protobuf:"bytes,2,opt,name=description,proto3" json:"description,omitempty"`
+	Gauge       *otlpGauge     `protobuf:"bytes,5,opt,name=gauge" json:"gauge,omitempty"`
+	Sum         *otlpSum       `protobuf:"bytes,7,opt,name=sum" json:"sum,omitempty"`
+	Histogram   *otlpHistogram `protobuf:"bytes,9,opt,name=histogram" json:"histogram,omitempty"`
+	Summary     *otlpSummary   `protobuf:"bytes,11,opt,name=summary" json:"summary,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []*otlpNumberDataPoint `protobuf:"bytes,1,rep,name=data_points,proto3" json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints             []*otlpNumberDataPoint `protobuf:"bytes,1,rep,name=data_points,proto3" json:"dataPoints"`
+	AggregationTemporality int32                  `protobuf:"varint,2,opt,name=aggregation_temporality,proto3" json:"aggregationTemporality"`
+	IsMonotonic            bool                   `protobuf:"varint,3,opt,name=is_monotonic,proto3" json:"isMonotonic"`
+}
+
+type otlpHistogram struct {
+	DataPoints             []*otlpHistogramDataPoint `protobuf:"bytes,1,rep,name=data_points,proto3" json:"dataPoints"`
+	AggregationTemporality int32                     `protobuf:"varint,2,opt,name=aggregation_temporality,proto3" json:"aggregationTemporality"`
+}
+
+type otlpSummary struct {
+	DataPoints []*otlpSummaryDataPoint `protobuf:"bytes,1,rep,name=data_points,proto3" json:"dataPoints"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes        []*otlpKeyValue `protobuf:"bytes,7,rep,name=attributes,proto3" json:"attributes,omitempty"`
+	StartTimeUnixNano uint64          `protobuf:"fixed64,2,opt,name=start_time_unix_nano,proto3" json:"startTimeUnixNano,string,omitempty"`
+	TimeUnixNano      uint64          `protobuf:"fixed64,3,opt,name=time_unix_nano,proto3" json:"timeUnixNano,string"`
+	AsDouble          *float64        `protobuf:"fixed64,4,opt,name=as_double" json:"asDouble,omitempty"`
+}
+
+type otlpHistogramDataPoint struct {
+	Attributes        []*otlpKeyValue `protobuf:"bytes,9,rep,name=attributes,proto3" json:"attributes,omitempty"`
+	StartTimeUnixNano uint64          `protobuf:"fixed64,2,opt,name=start_time_unix_nano,proto3" json:"startTimeUnixNano,string"`
+	TimeUnixNano      uint64          `protobuf:"fixed64,3,opt,name=time_unix_nano,proto3" json:"timeUnixNano,string"`
+	Count             uint64          `protobuf:"fixed64,4,opt,name=count,proto3" json:"count,string"`
+	Sum               *float64        `protobuf:"fixed64,5,opt,name=sum" json:"sum,omitempty"`
+	BucketCounts      otlpUint64s     `protobuf:"fixed64,6,rep,packed,name=bucket_counts,proto3" json:"bucketCounts"`
+	ExplicitBounds    []float64       `protobuf:"fixed64,7,rep,packed,name=explicit_bounds,proto3" json:"explicitBounds"`
+}
+
+type otlpSummaryDataPoint struct {
+	Attributes        []*otlpKeyValue        `protobuf:"bytes,7,rep,name=attributes,proto3" json:"attributes,omitempty"`
+	StartTimeUnixNano uint64                 `protobuf:"fixed64,2,opt,name=start_time_unix_nano,proto3" json:"startTimeUnixNano,string"`
+	TimeUnixNano      uint64                 `protobuf:"fixed64,3,opt,name=time_unix_nano,proto3" json:"timeUnixNano,string"`
+	Count             uint64                 `protobuf:"fixed64,4,opt,name=count,proto3" json:"count,string"`
+	Sum               float64                `protobuf:"fixed64,5,opt,name=sum,proto3" json:"sum"`
+	QuantileValues    []*otlpValueAtQuantile `protobuf:"bytes,6,rep,name=quantile_values,proto3" json:"quantileValues"`
+}
+
+type otlpValueAtQuantile struct {
+	Quantile float64 `protobuf:"fixed64,1,opt,name=quantile,proto3" json:"quantile"`
+	Value    float64 `protobuf:"fixed64,2,opt,name=value,proto3" json:"value"`
+}
+
+// otlpUint64s are encoded as JSON array of strings.
+type otlpUint64s []uint64
+
+func (u otlpUint64s) MarshalJSON() ([]byte, error) {
+	s := make([]string, len(u))
+	for i, v := range u {
+		s[i] = strconv.FormatUint(v, 10)
+	}
+	return json.Marshal(s)
+}
+
+func (u *otlpUint64s) UnmarshalJSON(data []byte) error {
+	var s []string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	*u = make(otlpUint64s, len(s))
+	for i, v := range s {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return err
+		}
+		(*u)[i] = n
+	}
+	return nil
+}
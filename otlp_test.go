@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func newTestOTLPOutput(t *testing.T, yaml string) *otlpOutput {
+	c, err := parseConfigString(yaml)
+	require.NoError(t, err)
+
+	registry := prometheus.NewRegistry()
+	g := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        "meter_temperature_celsius",
+		Help:        "Current temperature in Celsius",
+		ConstLabels: prometheus.Labels{"location": "fridge", "id": "91"},
+	})
+	g.Set(4.2)
+	registry.MustRegister(g)
+
+	c.OTLP.Device = "/dev/ttyUSB0"
+	o := newOTLPOutput(c.OTLP, registry, testTime.Add(-time.Hour))
+	o.backoff = time.Millisecond
+	return o
+}
+
+// assertOTLPRequest checks the request sent by an output created with newTestOTLPOutput.
+func assertOTLPRequest(t *testing.T, req *otlpExportRequest) {
+	require.Len(t, req.ResourceMetrics, 1)
+	rm := req.ResourceMetrics[0]
+
+	attributes := map[string]string{}
+	for _, a := range rm.Resource.Attributes {
+		attributes[a.Key] = *a.Value.StringValue
+	}
+	assert.Equal(t, "weather-station", attributes["service.name"])
+	assert.Equal(t, "/dev/ttyUSB0", attributes["weather_station.device"])
+	assert.Equal(t, "basement", attributes["site"])
+	assert.Equal(t, "prod", attributes["deployment.environment"])
+	assert.Contains(t, attributes, "host.name")
+
+	require.Len(t, rm.ScopeMetrics, 1)
+	temperature := 4.2
+	assert.Equal(t, []*otlpMetric{{
+		Name:        "meter_temperature_celsius",
+		Description: "Current temperature in Celsius",
+		Gauge: &otlpGauge{DataPoints: []*otlpNumberDataPoint{{
+			Attributes: []*otlpKeyValue{
+				newOTLPKeyValue("id", "91"),
+				newOTLPKeyValue("location", "fridge"),
+			},
+			TimeUnixNano: uint64(testTime.UnixNano()),
+			AsDouble:     &temperature,
+		}}},
+	}}, rm.ScopeMetrics[0].Metrics)
+}
+
+func TestOTLPOutput_httpProtobuf(t *testing.T) {
+	var requests []*otlpExportRequest
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/metrics", r.URL.Path)
+		assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+
+		body, _ := ioutil.ReadAll(r.Body)
+		var req otlpExportRequest
+		require.NoError(t, proto.Unmarshal(body, &req))
+		requests = append(requests, &req)
+	}))
+	defer s.Close()
+
+	o := newTestOTLPOutput(t, `
+otlp:
+  endpoint: `+s.URL+`
+  headers:
+    authorization: Bearer secret
+  resource_attributes:
+    site: basement
+    deployment.environment: prod
+`)
+
+	require.NoError(t, o.export(testTime))
+
+	require.Len(t, requests, 1)
+	assertOTLPRequest(t, requests[0])
+}
+
+func TestOTLPOutput_httpJSON(t *testing.T) {
+	var requests []*otlpExportRequest
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/otlp/v1/metrics", r.URL.Path, "Path of endpoint is kept")
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+
+		var req otlpExportRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		requests = append(requests, &req)
+	}))
+	defer s.Close()
+
+	o := newTestOTLPOutput(t, `
+otlp:
+  endpoint: `+s.URL+`/otlp/v1/metrics
+  protocol: http/json
+  resource_attributes:
+    site: basement
+    deployment.environment: prod
+`)
+
+	require.NoError(t, o.export(testTime))
+
+	require.Len(t, requests, 1)
+	assertOTLPRequest(t, requests[0])
+}
+
+func TestOTLPOutput_grpc(t *testing.T) {
+	var requests []*otlpExportRequest
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, 2, r.ProtoMajor)
+		assert.Equal(t, otlpExportMethod, r.URL.Path)
+		assert.Equal(t, "application/grpc+proto", r.Header.Get("Content-Type"))
+
+		body, _ := ioutil.ReadAll(r.Body)
+		require.True(t, len(body) >= 5)
+		assert.Equal(t, byte(0), body[0], "Message is not compressed")
+		require.Equal(t, uint32(len(body)-5), binary.BigEndian.Uint32(body[1:5]))
+
+		var req otlpExportRequest
+		require.NoError(t, proto.Unmarshal(body[5:], &req))
+		requests = append(requests, &req)
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte{0, 0, 0, 0, 0})
+		w.Header().Set("Grpc-Status", "0")
+	})
+	s := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	defer s.Close()
+
+	o := newTestOTLPOutput(t, `
+otlp:
+  endpoint: `+s.URL+`
+  protocol: grpc
+  resource_attributes:
+    site: basement
+    deployment.environment: prod
+`)
+
+	require.NoError(t, o.export(testTime))
+
+	require.Len(t, requests, 1)
+	assertOTLPRequest(t, requests[0])
+}
+
+func TestOTLPOutput_grpcError(t *testing.T) {
+	requests := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Status", "3")
+		w.Header().Set("Grpc-Message", "invalid%20metric")
+	})
+	s := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	defer s.Close()
+
+	o := newTestOTLPOutput(t, `
+otlp:
+  endpoint: `+s.URL+`
+  protocol: grpc
+`)
+
+	err := o.export(testTime)
+
+	assert.EqualError(t, err, "Failed to export to '"+s.URL+"': gRPC status 3: invalid metric")
+	assert.Equal(t, 1, requests, "Invalid arguments are not retried")
+}
+
+func TestOTLPOutput_retries(t *testing.T) {
+	statusCodes := []int{http.StatusServiceUnavailable, http.StatusBadRequest}
+	requests := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(statusCodes[requests])
+		requests++
+	}))
+	defer s.Close()
+
+	o := newTestOTLPOutput(t, `
+otlp:
+  endpoint: `+s.URL+`
+`)
+
+	err := o.export(testTime)
+
+	assert.IsType(t, permanentError{}, err)
+	assert.Equal(t, 2, requests, "Unavailable endpoint is retried, but rejected request is not")
+}
+
+func TestOTLPMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	c := prometheus.NewCounter(prometheus.CounterOpts{Name: "lines_read_total", Help: "Lines"})
+	c.Add(3)
+	h := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "duration_seconds", Help: "Duration",
+		Buckets: []float64{0.1, 1}})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(0.7)
+	h.Observe(2)
+	registry.MustRegister(c, h)
+	families, err := registry.Gather()
+	require.NoError(t, err)
+
+	start := testTime.Add(-time.Hour)
+	metrics := otlpMetrics(families, start, testTime)
+
+	sum := 3.25
+	lines := 3.0
+	assert.Equal(t, []*otlpMetric{
+		{
+			Name:        "duration_seconds",
+			Description: "Duration",
+			Histogram: &otlpHistogram{
+				AggregationTemporality: otlpCumulative,
+				DataPoints: []*otlpHistogramDataPoint{{
+					StartTimeUnixNano: uint64(start.UnixNano()),
+					TimeUnixNano:      uint64(testTime.UnixNano()),
+					Count:             4,
+					Sum:               &sum,
+					BucketCounts:      otlpUint64s{1, 2, 1},
+					ExplicitBounds:    []float64{0.1, 1},
+				}},
+			},
+		},
+		{
+			Name:        "lines_read_total",
+			Description: "Lines",
+			Sum: &otlpSum{
+				AggregationTemporality: otlpCumulative,
+				IsMonotonic:            true,
+				DataPoints: []*otlpNumberDataPoint{{
+					StartTimeUnixNano: uint64(start.UnixNano()),
+					TimeUnixNano:      uint64(testTime.UnixNano()),
+					AsDouble:          &lines,
+				}},
+			},
+		},
+	}, metrics)
+}
+
+func TestParseConfig_invalidOTLP(t *testing.T) {
+	_, err := parseConfigString(`
+otlp:
+  endpoint: localhost:4317
+  protocol: thrift
+  interval: 0s
+  resource_attributes:
+    rooms: [kitchen, basement]
+`)
+
+	assert.EqualError(t, err, `otlp: invalid url "localhost:4317" (must be http:// or https://); `+
+		`otlp: invalid protocol "thrift" (supported: http/protobuf, http/json, grpc); `+
+		"otlp: interval must be positive, got 0s; "+
+		"otlp: resource attribute rooms must be a string, number or boolean")
+}
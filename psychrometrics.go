@@ -0,0 +1,93 @@
+package main
+
+import (
+	"math"
+)
+
+// Names of the metrics that can be derived from temperature and humidity
+// (see config option derived_metrics).
+const (
+	DewPoint             = "dew_point"
+	AbsoluteHumidity     = "absolute_humidity"
+	VaporPressureDeficit = "vapor_pressure_deficit"
+	HeatIndex            = "heat_index"
+)
+
+// derivations maps the names of derived metrics to the functions computing them
+// from temperature in Celsius and relative humidity in %.
+var derivations = map[string]func(temperature, humidity float64) float64{
+	DewPoint:             dewPoint,
+	AbsoluteHumidity:     absoluteHumidity,
+	VaporPressureDeficit: vaporPressureDeficit,
+	HeatIndex:            heatIndex,
+}
+
+// derivedMetricNames returns the names of all metrics that can be derived.
+func derivedMetricNames() []string {
+	return []string{DewPoint, AbsoluteHumidity, VaporPressureDeficit, HeatIndex}
+}
+
+// Coefficients of the Magnus formula over water
+// (see: https://en.wikipedia.org/wiki/Clausius%E2%80%93Clapeyron_relation#Meteorology_and_climatology).
+const (
+	magnusA = 611.2 // Pa
+	magnusB = 17.62
+	magnusC = 243.12 // °C
+)
+
+// saturationVaporPressure returns the saturation vapor pressure in Pa
+// at the given temperature in Celsius.
+func saturationVaporPressure(temperature float64) float64 {
+	return magnusA * math.Exp(magnusB*temperature/(magnusC+temperature))
+}
+
+// vaporPressure returns the (partial) vapor pressure in Pa
+// at the given temperature in Celsius and relative humidity in %.
+func vaporPressure(temperature, humidity float64) float64 {
+	return humidity / 100 * saturationVaporPressure(temperature)
+}
+
+// dewPoint returns the dew point in Celsius, i.e. the temperature at which
+// water starts to condense. It is NaN if the humidity is not positive.
+func dewPoint(temperature, humidity float64) float64 {
+	if humidity <= 0 {
+		return math.NaN()
+	}
+	gamma := math.Log(humidity/100) + magnusB*temperature/(magnusC+temperature)
+	return magnusC * gamma / (magnusB - gamma)
+}
+
+// absoluteHumidity returns the mass of water vapor in g/m³ of air.
+func absoluteHumidity(temperature, humidity float64) float64 {
+	const specificGasConstantWater = 461.5 // J/(kg·K)
+	kelvin := temperature + 273.15
+	return vaporPressure(temperature, humidity) / (specificGasConstantWater * kelvin) * 1000
+}
+
+// vaporPressureDeficit returns the difference in Pa between the saturation vapor pressure
+// and the actual vapor pressure, i.e. the drying power of the air.
+func vaporPressureDeficit(temperature, humidity float64) float64 {
+	return saturationVaporPressure(temperature) - vaporPressure(temperature, humidity)
+}
+
+// heatIndex returns the apparent temperature in Celsius as defined by the US National Weather Service
+// (see: https://www.wpc.ncep.noaa.gov/html/heatindex_equation.shtml).
+func heatIndex(temperature, humidity float64) float64 {
+	t := temperature*9/5 + 32
+	rh := humidity
+
+	hi := 0.5 * (t + 61.0 + (t-68.0)*1.2 + rh*0.094)
+	if (hi+t)/2 >= 80 {
+		hi = -42.379 + 2.04901523*t + 10.14333127*rh -
+			0.22475541*t*rh - 0.00683783*t*t - 0.05481717*rh*rh +
+			0.00122874*t*t*rh + 0.00085282*t*rh*rh - 0.00000199*t*t*rh*rh
+
+		if rh < 13 && t >= 80 && t <= 112 {
+			hi -= (13 - rh) / 4 * math.Sqrt((17-math.Abs(t-95))/17)
+		} else if rh > 85 && t >= 80 && t <= 87 {
+			hi += (rh - 85) / 10 * (87 - t) / 5
+		}
+	}
+
+	return (hi - 32) * 5 / 9
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDewPoint(t *testing.T) {
+	assert.InDelta(t, 12.0, dewPoint(20, 60), 0.1)
+	assert.InDelta(t, 20.0, dewPoint(20, 100), 1e-9)
+	assert.InDelta(t, -12.0, dewPoint(0, 40), 0.1)
+	assert.True(t, math.IsNaN(dewPoint(20, 0)), "Dew point is undefined for 0% humidity")
+}
+
+func TestAbsoluteHumidity(t *testing.T) {
+	assert.InDelta(t, 17.3, absoluteHumidity(20, 100), 0.1)
+	assert.InDelta(t, 10.4, absoluteHumidity(20, 60), 0.1)
+	assert.InDelta(t, 2.6, absoluteHumidity(-5, 75), 0.1)
+}
+
+func TestVaporPressureDeficit(t *testing.T) {
+	assert.InDelta(t, 933, vaporPressureDeficit(20, 60), 1)
+	assert.InDelta(t, 0, vaporPressureDeficit(20, 100), 1e-9)
+}
+
+func TestHeatIndex(t *testing.T) {
+	assert.InDelta(t, 19.6, heatIndex(20, 60), 0.1, "Simple formula for low temperatures")
+	assert.InDelta(t, 37.1, heatIndex(32, 60), 0.1, "Rothfusz regression")
+	assert.InDelta(t, 28.8, heatIndex(30, 30), 0.1)
+}
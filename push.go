@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/expfmt"
+)
+
+// PushgatewayConfig configures periodically pushing all metrics to a Pushgateway,
+// e.g. if Prometheus can't scrape the exporter as it is behind NAT.
+type PushgatewayConfig struct {
+	// URL of the Pushgateway (pushing is disabled if not set)
+	URL string `mapstructure:"url"`
+	// Job is the job label of the pushed metrics
+	Job string `mapstructure:"job"`
+	// Grouping are additional labels identifying the group of pushed metrics, e.g. the instance
+	Grouping map[string]string `mapstructure:"grouping"`
+	// Interval is the time between two pushes
+	Interval time.Duration `mapstructure:"interval"`
+	Username string        `mapstructure:"username"`
+	Password string        `mapstructure:"password"`
+}
+
+func (p PushgatewayConfig) validate() ValidationErrors {
+	var errs ValidationErrors
+	if p.URL == "" {
+		return errs
+	}
+
+	if err := validateURL(p.URL); err != nil {
+		errs = append(errs, fmt.Errorf("pushgateway: %v", err))
+	}
+	if p.Job == "" {
+		errs = append(errs, fmt.Errorf("pushgateway: job must not be empty"))
+	}
+	if p.Interval <= 0 {
+		errs = append(errs, fmt.Errorf("pushgateway: interval must be positive, got %v", p.Interval))
+	}
+	for _, err := range validateLabels(p.Grouping) {
+		errs = append(errs, fmt.Errorf("pushgateway grouping: %v", err))
+	}
+	return errs
+}
+
+// validateURL checks that u is an absolute HTTP(S) URL.
+func validateURL(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return fmt.Errorf("invalid url %q", u)
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("invalid url %q (must be http:// or https://)", u)
+	}
+	return nil
+}
+
+func (e *Exporter) pushPeriodically(ctx context.Context) {
+	client := &http.Client{Timeout: e.config.Pushgateway.Interval}
+	ticker := time.NewTicker(e.config.Pushgateway.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := e.push(client); err != nil {
+			log.Println(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// push replaces the group of metrics on the Pushgateway with the current metrics.
+// The push package of client_golang is not used, as it only accepts
+// the status code of older Pushgateway versions.
+func (e *Exporter) push(client *http.Client) error {
+	c := e.config.Pushgateway
+
+	families, err := e.gatherer().Gather()
+	if err != nil {
+		return errors.Wrap(err, "Failed to gather metrics")
+	}
+
+	var buf bytes.Buffer
+	enc := expfmt.NewEncoder(&buf, expfmt.FmtProtoDelim)
+	for _, f := range families {
+		if err := enc.Encode(f); err != nil {
+			return errors.Wrap(err, "Failed to encode metrics")
+		}
+	}
+
+	groupURL := c.groupURL()
+	req, err := http.NewRequest(http.MethodPut, groupURL, &buf)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to push to '%s'", groupURL)
+	}
+	req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to push to '%s'", groupURL)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("Failed to push to '%s': %s: %s", groupURL, resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// groupURL returns the URL of the group of pushed metrics, given by job and grouping labels.
+func (p PushgatewayConfig) groupURL() string {
+	u := strings.TrimSuffix(p.URL, "/") + "/metrics" + pushgatewayPathSegment("job", p.Job)
+	for _, name := range sortedKeys(p.Grouping) {
+		u += pushgatewayPathSegment(name, p.Grouping[name])
+	}
+	return u
+}
+
+// pushgatewayPathSegment returns the path segment of a grouping label. Values that
+// can't be part of the path are base64 encoded, which is understood by the Pushgateway.
+func pushgatewayPathSegment(name, value string) string {
+	if value == "" {
+		// an empty value is encoded as a single padding character
+		return "/" + name + "@base64/="
+	}
+	if strings.Contains(value, "/") {
+		return "/" + name + "@base64/" + base64.URLEncoding.EncodeToString([]byte(value))
+	}
+	return "/" + name + "/" + url.PathEscape(value)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPush(t *testing.T) {
+	var path string
+	var families []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPut, r.Method)
+		path = r.URL.EscapedPath()
+
+		dec := expfmt.NewDecoder(r.Body, expfmt.ResponseFormat(r.Header))
+		for {
+			var f dto.MetricFamily
+			if err := dec.Decode(&f); err == io.EOF {
+				break
+			} else if !assert.NoError(t, err) {
+				break
+			}
+			families = append(families, f.GetName())
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer s.Close()
+
+	c, err := parseConfigString(`
+pushgateway:
+  url: ` + s.URL + `
+  grouping:
+    instance: pi
+`)
+	require.NoError(t, err)
+
+	e := newTestExporter(t, c)
+	require.NoError(t, e.push(s.Client()))
+
+	assert.Equal(t, "/metrics/job/weather-station/instance/pi", path)
+	assert.Contains(t, families, "meter_receiver_lines_read_total")
+}
+
+func TestPush_error(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "pushed metrics are invalid", http.StatusBadRequest)
+	}))
+	defer s.Close()
+
+	c := loadSampleConfig()
+	c.Pushgateway.URL = s.URL
+	c.Pushgateway.Job = "weather-station"
+
+	err := newTestExporter(t, c).push(s.Client())
+
+	assert.EqualError(t, err, "Failed to push to '"+s.URL+"/metrics/job/weather-station': "+
+		"400 Bad Request: pushed metrics are invalid")
+}
+
+func TestPushgatewayConfig_groupURL(t *testing.T) {
+	p := PushgatewayConfig{
+		URL:      "http://pushgateway:9091/",
+		Job:      "weather station",
+		Grouping: map[string]string{"path": "/home/pi", "instance": "pi", "empty": ""},
+	}
+
+	assert.Equal(t, "http://pushgateway:9091/metrics/job/weather%20station"+
+		"/empty@base64/=/instance/pi/path@base64/L2hvbWUvcGk=", p.groupURL())
+}
+
+func TestParseConfig_invalidPush(t *testing.T) {
+	_, err := parseConfigString(`
+metrics:
+  timestamps: true
+pushgateway:
+  url: pushgateway:9091
+  interval: 0s
+remote_write:
+  url: http://prometheus:9090/api/v1/write
+  retries: -1
+`)
+
+	assert.EqualError(t, err, `pushgateway: invalid url "pushgateway:9091" (must be http:// or https://); `+
+		"pushgateway: interval must be positive, got 0s; "+
+		"remote_write: retries must not be negative, got -1; "+
+		"pushgateway doesn't accept metrics with timestamps")
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+// readingsSaveDelay debounces writing the latest readings to the state file,
+// so that readings received shortly after each other are written at once.
+const readingsSaveDelay = 10 * time.Second
+
+// Reading is a decoded signal of a configured sensor,
+// with the sensor's calibration applied.
+type Reading struct {
+	Sensor      *SensorConfig
+	Time        time.Time // reception time of the signal
+	Channel     int
+	Temperature float64
+	Humidity    float64
+	LowBattery  bool
+
+	// uncalibrated values as decoded from the signal
+	RawTemperature float64
+	RawHumidity    float64
+}
+
+// NewReading creates a Reading from the decoded signal of a sensor
+// by applying the sensor's calibration.
+func NewReading(s *SensorConfig, m *GTWT01Result, t time.Time) *Reading {
+	return &Reading{
+		Sensor:         s,
+		Time:           t,
+		Channel:        m.Channel,
+		Temperature:    s.Calibration.Temperature.Apply(m.Temperature),
+		Humidity:       clampHumidity(s.Calibration.Humidity.Apply(float64(m.Humidity))),
+		LowBattery:     m.LowBattery,
+		RawTemperature: m.Temperature,
+		RawHumidity:    float64(m.Humidity),
+	}
+}
+
+// Stale checks whether the reading is older than the stale timeout of its sensor,
+// i.e. the sensor has not been received for too long and its values should no longer be exported.
+func (r *Reading) Stale(now time.Time) bool {
+	return now.Sub(r.Time) > r.Sensor.StaleTimeout
+}
+
+// Readings holds the latest reading of each sensor
+// and is safe for concurrent use. The readings are persisted
+// in a file (if given), so that they are restored after restarts.
+type Readings struct {
+	sync.RWMutex
+	latest map[string]*Reading
+	file   string
+	// pending is the timer of the next save, if any
+	pending *time.Timer
+	// dirty is set if readings have changed since they have been saved
+	dirty bool
+	// saving serializes writing the file
+	saving sync.Mutex
+}
+
+// savedReading is a reading as persisted in the state file.
+type savedReading struct {
+	Time           time.Time `json:"time"`
+	Channel        int       `json:"channel"`
+	Temperature    float64   `json:"temperature"`
+	Humidity       float64   `json:"humidity"`
+	LowBattery     bool      `json:"low_battery"`
+	RawTemperature float64   `json:"raw_temperature"`
+	RawHumidity    float64   `json:"raw_humidity"`
+}
+
+// NewReadings creates an empty Readings.
+func NewReadings() *Readings {
+	return &Readings{
+		latest: map[string]*Reading{},
+	}
+}
+
+// LoadReadings creates Readings with the readings of the given sensors persisted in file,
+// which keep the time they have been received. A missing file results in no readings.
+func LoadReadings(file string, sensors map[string]*SensorConfig) (*Readings, error) {
+	rs := NewReadings()
+	rs.file = file
+	if file == "" {
+		return rs, nil
+	}
+
+	data, err := afero.ReadFile(AppFs, file)
+	if os.IsNotExist(err) {
+		return rs, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read readings state '%s'", file)
+	}
+
+	var saved map[string]savedReading
+	err = json.Unmarshal(data, &saved)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse readings state '%s'", file)
+	}
+
+	for id, r := range saved {
+		// sensors might have been removed from the config since
+		s, ok := sensors[id]
+		if !ok {
+			continue
+		}
+		rs.latest[id] = &Reading{
+			Sensor:         s,
+			Time:           r.Time,
+			Channel:        r.Channel,
+			Temperature:    r.Temperature,
+			Humidity:       r.Humidity,
+			LowBattery:     r.LowBattery,
+			RawTemperature: r.RawTemperature,
+			RawHumidity:    r.RawHumidity,
+		}
+	}
+	return rs, nil
+}
+
+// Set stores r as the latest reading of its sensor.
+func (rs *Readings) Set(r *Reading) {
+	rs.Lock()
+	defer rs.Unlock()
+	rs.latest[r.Sensor.ID] = r
+	rs.dirty = true
+
+	if rs.file != "" && rs.pending == nil {
+		rs.pending = time.AfterFunc(readingsSaveDelay, func() {
+			if err := rs.save(); err != nil {
+				log.Println(err)
+			}
+		})
+	}
+}
+
+// Get returns the latest reading of a sensor or nil if
+// the sensor has not been received yet.
+func (rs *Readings) Get(id string) *Reading {
+	rs.RLock()
+	defer rs.RUnlock()
+	return rs.latest[id]
+}
+
+// Flush writes the readings to the file right away if they have changed since they have been saved.
+// It returns once the readings have been written, even if a pending save is already in progress.
+func (rs *Readings) Flush() error {
+	rs.Lock()
+	if rs.pending != nil {
+		rs.pending.Stop()
+	}
+	rs.Unlock()
+
+	return rs.save()
+}
+
+// save writes the readings to the file if they have changed since they have been saved.
+func (rs *Readings) save() error {
+	rs.saving.Lock()
+	defer rs.saving.Unlock()
+
+	rs.Lock()
+	if !rs.dirty || rs.file == "" {
+		rs.Unlock()
+		return nil
+	}
+	rs.pending = nil
+	rs.dirty = false
+	saved := make(map[string]savedReading, len(rs.latest))
+	for id, r := range rs.latest {
+		saved[id] = savedReading{
+			Time:           r.Time,
+			Channel:        r.Channel,
+			Temperature:    r.Temperature,
+			Humidity:       r.Humidity,
+			LowBattery:     r.LowBattery,
+			RawTemperature: r.RawTemperature,
+			RawHumidity:    r.RawHumidity,
+		}
+	}
+	rs.Unlock()
+
+	data, err := json.Marshal(saved)
+	if err == nil {
+		err = writeFileAtomic(rs.file, data)
+	}
+	if err != nil {
+		// saved again by the next Flush
+		rs.Lock()
+		rs.dirty = true
+		rs.Unlock()
+	}
+	return err
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewReading(t *testing.T) {
+	gain := 0.9
+	s := &SensorConfig{
+		ID:       "91",
+		Location: "fridge",
+		Protocol: "weather12",
+		Calibration: Calibration{
+			Temperature: Correction{Offset: -1.5},
+			Humidity:    Correction{Gain: &gain},
+		},
+	}
+	m := &GTWT01Result{ID: 91, Name: "91", Channel: 1, Temperature: 18.7, Humidity: 50, LowBattery: true}
+
+	r := NewReading(s, m, testTime)
+
+	assert.InDelta(t, 17.2, r.Temperature, 1e-9)
+	assert.InDelta(t, 45.0, r.Humidity, 1e-9)
+	assert.Equal(t, 18.7, r.RawTemperature)
+	assert.Equal(t, 50.0, r.RawHumidity)
+	assert.Equal(t, 1, r.Channel)
+	assert.True(t, r.LowBattery)
+	assert.Equal(t, testTime, r.Time)
+}
+
+func TestNewReading_clampsHumidity(t *testing.T) {
+	s := &SensorConfig{ID: "91", Calibration: Calibration{Humidity: Correction{Offset: 5}}}
+
+	r := NewReading(s, &GTWT01Result{Humidity: 98}, testTime)
+	assert.Equal(t, 100.0, r.Humidity)
+	assert.Equal(t, 98.0, r.RawHumidity, "Raw value is not clamped")
+
+	s.Calibration.Humidity.Offset = -5
+	r = NewReading(s, &GTWT01Result{Humidity: 2}, testTime)
+	assert.Equal(t, 0.0, r.Humidity)
+}
+
+func TestReading_Stale(t *testing.T) {
+	r := &Reading{
+		Sensor: &SensorConfig{ID: "91", Location: "fridge", StaleTimeout: 5 * time.Minute},
+		Time:   testTime,
+	}
+
+	assert.False(t, r.Stale(testTime.Add(5*time.Minute)))
+	assert.True(t, r.Stale(testTime.Add(6*time.Minute)))
+}
+
+func TestReadings_persists(t *testing.T) {
+	AppFs = afero.NewMemMapFs()
+	sensors := map[string]*SensorConfig{"91": {ID: "91", Location: "fridge"}}
+
+	rs, err := LoadReadings("/var/lib/readings.json", sensors)
+	require.NoError(t, err, "Missing state file results in no readings")
+	rs.Set(&Reading{Sensor: sensors["91"], Time: testTime, Channel: 1, Temperature: 4.2, Humidity: 60,
+		LowBattery: true, RawTemperature: 4.5, RawHumidity: 58})
+	rs.Set(&Reading{Sensor: &SensorConfig{ID: "92"}, Time: testTime, Temperature: 12})
+
+	exists, _ := afero.Exists(AppFs, "/var/lib/readings.json")
+	assert.False(t, exists, "Saving is delayed")
+	require.NoError(t, rs.Flush())
+
+	rs, err = LoadReadings("/var/lib/readings.json", sensors)
+	require.NoError(t, err)
+	assert.Equal(t, &Reading{Sensor: sensors["91"], Time: testTime, Channel: 1, Temperature: 4.2, Humidity: 60,
+		LowBattery: true, RawTemperature: 4.5, RawHumidity: 58}, rs.Get("91"))
+	assert.Nil(t, rs.Get("92"), "Readings of sensors that are no longer configured are dropped")
+
+	files, _ := afero.ReadDir(AppFs, "/var/lib")
+	assert.Len(t, files, 1, "No temporary files are left behind")
+}
+
+func TestReadings_Flush_withoutChanges(t *testing.T) {
+	AppFs = afero.NewMemMapFs()
+
+	rs, err := LoadReadings("/var/lib/readings.json", nil)
+	require.NoError(t, err)
+	require.NoError(t, rs.Flush())
+
+	exists, _ := afero.Exists(AppFs, "/var/lib/readings.json")
+	assert.False(t, exists, "Nothing to save")
+}
+
+func TestReadings_Flush_afterTimerFired(t *testing.T) {
+	AppFs = afero.NewMemMapFs()
+	sensors := map[string]*SensorConfig{"91": {ID: "91", Location: "fridge"}}
+
+	rs, err := LoadReadings("/var/lib/readings.json", sensors)
+	require.NoError(t, err)
+	rs.Set(&Reading{Sensor: sensors["91"], Time: testTime, Temperature: 4.2})
+	// the timer has fired, but its save has not run yet
+	rs.pending.Stop()
+	require.NoError(t, rs.Flush())
+
+	rs, err = LoadReadings("/var/lib/readings.json", sensors)
+	require.NoError(t, err)
+	if assert.NotNil(t, rs.Get("91"), "Saved although the timer has fired") {
+		assert.Equal(t, 4.2, rs.Get("91").Temperature)
+	}
+}
+
+func TestLoadReadings_invalidState(t *testing.T) {
+	AppFs = afero.NewMemMapFs()
+	afero.WriteFile(AppFs, "/var/lib/readings.json", []byte("{"), 0644)
+
+	_, err := LoadReadings("/var/lib/readings.json", nil)
+
+	assert.Error(t, err)
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/spf13/afero"
+)
+
+// RemoteWriteConfig configures periodically sending all metrics
+// to an endpoint implementing the Prometheus remote-write protocol.
+type RemoteWriteConfig struct {
+	// URL of the remote-write endpoint (writing is disabled if not set)
+	URL string `mapstructure:"url"`
+	// Interval is the time between two writes
+	Interval time.Duration `mapstructure:"interval"`
+	// Timeout limits the time of a single request
+	Timeout time.Duration `mapstructure:"timeout"`
+	// Retries is the number of times a failed request is retried, after 1s and twice as long before every further retry
+	Retries int `mapstructure:"retries"`
+	// BufferDir keeps requests that failed despite retries to send them later,
+	// e.g. during network outages (requests are dropped if not set)
+	BufferDir string `mapstructure:"buffer_dir"`
+	// BufferSize is the maximum number of buffered requests, the oldest are dropped first
+	BufferSize int    `mapstructure:"buffer_size"`
+	Username   string `mapstructure:"username"`
+	Password   string `mapstructure:"password"`
+}
+
+func (r RemoteWriteConfig) validate() ValidationErrors {
+	var errs ValidationErrors
+	if r.URL == "" {
+		return errs
+	}
+
+	if err := validateURL(r.URL); err != nil {
+		errs = append(errs, fmt.Errorf("remote_write: %v", err))
+	}
+	if r.Interval <= 0 {
+		errs = append(errs, fmt.Errorf("remote_write: interval must be positive, got %v", r.Interval))
+	}
+	if r.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("remote_write: timeout must be positive, got %v", r.Timeout))
+	}
+	if r.Retries < 0 {
+		errs = append(errs, fmt.Errorf("remote_write: retries must not be negative, got %d", r.Retries))
+	}
+	if r.BufferSize <= 0 {
+		errs = append(errs, fmt.Errorf("remote_write: buffer size must be positive, got %d", r.BufferSize))
+	}
+	return errs
+}
+
+// remoteWriter sends snapshots of all metrics to a remote-write endpoint.
+// Requests that can't be sent are buffered on disk and sent
+// (oldest first) as soon as the endpoint is available again.
+type remoteWriter struct {
+	config   RemoteWriteConfig
+	gatherer prometheus.Gatherer
+	client   *http.Client
+	// backoff is the delay before the first retry, which doubles with every retry
+	backoff time.Duration
+}
+
+func newRemoteWriter(c RemoteWriteConfig, g prometheus.Gatherer) (*remoteWriter, error) {
+	if c.BufferDir != "" {
+		if err := AppFs.MkdirAll(c.BufferDir, 0755); err != nil {
+			return nil, errors.Wrapf(err, "Failed to create remote-write buffer '%s'", c.BufferDir)
+		}
+	}
+
+	return &remoteWriter{
+		config:   c,
+		gatherer: g,
+		client:   &http.Client{Timeout: c.Timeout},
+		backoff:  time.Second,
+	}, nil
+}
+
+func (w *remoteWriter) run(ctx context.Context) {
+	ticker := time.NewTicker(w.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			w.write(now)
+		}
+	}
+}
+
+// write sends the current metrics, preceded by all buffered requests.
+func (w *remoteWriter) write(now time.Time) {
+	data, err := w.request(now)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	err = w.flush()
+	if err == nil {
+		err = w.send(data)
+	}
+	if err == nil {
+		return
+	}
+
+	log.Println(err)
+	if _, ok := err.(permanentError); !ok {
+		w.buffer(data, now)
+	}
+}
+
+// request returns the snappy-compressed remote-write request of the current metrics.
+// Samples without a timestamp get the given time.
+func (w *remoteWriter) request(now time.Time) ([]byte, error) {
+	families, err := w.gatherer.Gather()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to gather metrics")
+	}
+
+	data, err := proto.Marshal(&writeRequest{Timeseries: toTimeSeries(families, now)})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to encode remote-write request")
+	}
+	return snappy.Encode(nil, data), nil
+}
+
+// permanentError is returned for requests that are rejected by the endpoint,
+// so that retrying them is pointless.
+type permanentError struct {
+	error
+}
+
+// send posts a request and retries it with exponential backoff, unless it is rejected.
+func (w *remoteWriter) send(data []byte) error {
+	return retry(w.config.Retries, w.backoff, func() error {
+		return w.post(data)
+	})
+}
+
+// retry calls f until it succeeds, returns a permanentError or has been retried the given
+// number of times. The delay before the first retry is given by backoff and doubles with every retry.
+func retry(retries int, backoff time.Duration, f func() error) error {
+	return retryContext(context.Background(), retries, backoff, f)
+}
+
+// retryContext is like retry, but stops waiting for the next retry when ctx is done.
+func retryContext(ctx context.Context, retries int, backoff time.Duration, f func() error) error {
+	for i := 0; ; i++ {
+		err := f()
+		if _, ok := err.(permanentError); ok || err == nil || i == retries {
+			return err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+func (w *remoteWriter) post(data []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.config.URL, bytes.NewReader(data))
+	if err != nil {
+		return permanentError{errors.Wrapf(err, "Failed to write to '%s'", w.config.URL)}
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if w.config.Username != "" {
+		req.SetBasicAuth(w.config.Username, w.config.Password)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write to '%s'", w.config.URL)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	err = errors.Errorf("Failed to write to '%s': %s: %s", w.config.URL, resp.Status, bytes.TrimSpace(body))
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+		return permanentError{err}
+	}
+	return err
+}
+
+// buffer keeps a request on disk to send it later.
+func (w *remoteWriter) buffer(data []byte, now time.Time) {
+	if w.config.BufferDir == "" {
+		log.Println("Dropping remote-write request, as no buffer is configured")
+		return
+	}
+
+	files, err := w.buffered()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for len(files) >= w.config.BufferSize {
+		log.Printf("Remote-write buffer is full, dropping oldest request '%s'", files[0])
+		AppFs.Remove(files[0])
+		files = files[1:]
+	}
+
+	name := filepath.Join(w.config.BufferDir, fmt.Sprintf("%020d.snappy", now.UnixNano()))
+	if err := writeFileAtomic(name, data); err != nil {
+		log.Println(err)
+	}
+}
+
+// flush sends all buffered requests, oldest first.
+func (w *remoteWriter) flush() error {
+	files, err := w.buffered()
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		data, err := afero.ReadFile(AppFs, f)
+		if err != nil {
+			return errors.Wrap(err, "Failed to read buffered remote-write request")
+		}
+
+		err = w.send(data)
+		if _, ok := err.(permanentError); ok {
+			log.Println(err)
+		} else if err != nil {
+			return err
+		}
+
+		if err := AppFs.Remove(f); err != nil {
+			return errors.Wrap(err, "Failed to remove buffered remote-write request")
+		}
+	}
+	return nil
+}
+
+// buffered returns the files of all buffered requests, oldest first.
+func (w *remoteWriter) buffered() ([]string, error) {
+	if w.config.BufferDir == "" {
+		return nil, nil
+	}
+
+	infos, err := afero.ReadDir(AppFs, w.config.BufferDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read remote-write buffer")
+	}
+
+	var files []string
+	for _, info := range infos {
+		if !info.IsDir() && filepath.Ext(info.Name()) == ".snappy" && !strings.HasPrefix(info.Name(), ".") {
+			files = append(files, filepath.Join(w.config.BufferDir, info.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// toTimeSeries converts metric families into the time series of the remote-write protocol,
+// in the same way Prometheus does when scraping them.
+func toTimeSeries(families []*dto.MetricFamily, now time.Time) []*timeSeries {
+	var series []*timeSeries
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			t := now.UnixNano() / int64(time.Millisecond)
+			if m.TimestampMs != nil {
+				t = m.GetTimestampMs()
+			}
+			add := func(name string, value float64, extra ...string) {
+				series = append(series, newTimeSeries(name, m.GetLabel(), value, t, extra...))
+			}
+
+			switch f.GetType() {
+			case dto.MetricType_COUNTER:
+				add(f.GetName(), m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(f.GetName(), m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(f.GetName(), m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					add(f.GetName(), q.GetValue(), "quantile", formatFloat(q.GetQuantile()))
+				}
+				add(f.GetName()+"_sum", s.GetSampleSum())
+				add(f.GetName()+"_count", float64(s.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.GetBucket() {
+					add(f.GetName()+"_bucket", float64(b.GetCumulativeCount()), "le", formatFloat(b.GetUpperBound()))
+				}
+				add(f.GetName()+"_bucket", float64(h.GetSampleCount()), "le", "+Inf")
+				add(f.GetName()+"_sum", h.GetSampleSum())
+				add(f.GetName()+"_count", float64(h.GetSampleCount()))
+			}
+		}
+	}
+	return series
+}
+
+// newTimeSeries creates a time series with a single sample. Labels are sorted by name,
+// as required by the protocol. extra are pairs of label names and values.
+func newTimeSeries(name string, labels []*dto.LabelPair, value float64, t int64, extra ...string) *timeSeries {
+	ts := &timeSeries{
+		Labels:  []*label{{Name: "__name__", Value: name}},
+		Samples: []*sample{{Value: value, Timestamp: t}},
+	}
+	for _, l := range labels {
+		ts.Labels = append(ts.Labels, &label{Name: l.GetName(), Value: l.GetValue()})
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		ts.Labels = append(ts.Labels, &label{Name: extra[i], Value: extra[i+1]})
+	}
+	sort.Slice(ts.Labels, func(i, j int) bool {
+		return ts.Labels[i].Name < ts.Labels[j].Name
+	})
+	return ts
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// The messages of the remote-write protocol (see prometheus/prompb/remote.proto
+// and types.proto), declared here as the generated package has lots of dependencies.
+
+type writeRequest struct {
+	Timeseries []*timeSeries `protobuf:"bytes,1,rep,name=timeseries,proto3"`
+}
+
+func (m *writeRequest) Reset()         { *m = writeRequest{} }
+func (m *writeRequest) String() string { return proto.CompactTextString(m) }
+func (*writeRequest) ProtoMessage()    {}
+
+type timeSeries struct {
+	Labels  []*label  `protobuf:"bytes,1,rep,name=labels,proto3"`
+	Samples []*sample `protobuf:"bytes,2,rep,name=samples,proto3"`
+}
+
+func (m *timeSeries) Reset()         { *m = timeSeries{} }
+func (m *timeSeries) String() string { return proto.CompactTextString(m) }
+func (*timeSeries) ProtoMessage()    {}
+
+type label struct {
+	Name  string `protobuf:"bytes,1,opt,name=name,proto3"`
+	Value string `protobuf:"bytes,2,opt,name=value,proto3"`
+}
+
+func (m *label) Reset()         { *m = label{} }
+func (m *label) String() string { return proto.CompactTextString(m) }
+func (*label) ProtoMessage()    {}
+
+type sample struct {
+	Value     float64 `protobuf:"fixed64,1,opt,name=value,proto3"`
+	Timestamp int64   `protobuf:"varint,2,opt,name=timestamp,proto3"`
+}
+
+func (m *sample) Reset()         { *m = sample{} }
+func (m *sample) String() string { return proto.CompactTextString(m) }
+func (*sample) ProtoMessage()    {}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// remoteWriteServer is a stand-in for a remote-write endpoint, which
+// responds with the given status codes (and 200 OK afterwards).
+type remoteWriteServer struct {
+	*httptest.Server
+	sync.Mutex
+	statusCodes []int
+	requests    []*writeRequest
+}
+
+func newRemoteWriteServer(t *testing.T, statusCodes ...int) *remoteWriteServer {
+	s := &remoteWriteServer{statusCodes: statusCodes}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Lock()
+		defer s.Unlock()
+
+		if len(s.statusCodes) > 0 {
+			code := s.statusCodes[0]
+			s.statusCodes = s.statusCodes[1:]
+			if code != http.StatusOK {
+				w.WriteHeader(code)
+				return
+			}
+		}
+
+		assert.Equal(t, "snappy", r.Header.Get("Content-Encoding"))
+		assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+
+		compressed, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		data, err := snappy.Decode(nil, compressed)
+		require.NoError(t, err)
+
+		var req writeRequest
+		require.NoError(t, proto.Unmarshal(data, &req))
+		s.requests = append(s.requests, &req)
+	}))
+	return s
+}
+
+func newTestRemoteWriter(t *testing.T, url string, bufferDir string) *remoteWriter {
+	registry := prometheus.NewRegistry()
+	g := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        "meter_temperature_celsius",
+		Help:        "Current temperature in Celsius",
+		ConstLabels: prometheus.Labels{"location": "fridge", "id": "91"},
+	})
+	g.Set(4.2)
+	registry.MustRegister(g)
+
+	w, err := newRemoteWriter(RemoteWriteConfig{
+		URL:        url,
+		Timeout:    time.Second,
+		Retries:    2,
+		BufferDir:  bufferDir,
+		BufferSize: 2,
+	}, registry)
+	require.NoError(t, err)
+	w.backoff = time.Millisecond
+	return w
+}
+
+func TestRemoteWriter_write(t *testing.T) {
+	s := newRemoteWriteServer(t)
+	defer s.Close()
+
+	newTestRemoteWriter(t, s.URL, "").write(testTime)
+
+	require.Len(t, s.requests, 1)
+	assert.Equal(t, []*timeSeries{{
+		Labels: []*label{
+			{Name: "__name__", Value: "meter_temperature_celsius"},
+			{Name: "id", Value: "91"},
+			{Name: "location", Value: "fridge"},
+		},
+		Samples: []*sample{{Value: 4.2, Timestamp: testTime.Unix() * 1000}},
+	}}, s.requests[0].Timeseries)
+}
+
+func TestRemoteWriter_retries(t *testing.T) {
+	s := newRemoteWriteServer(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	defer s.Close()
+
+	newTestRemoteWriter(t, s.URL, "").write(testTime)
+
+	assert.Len(t, s.requests, 1, "Written after two retries")
+}
+
+func TestRemoteWriter_buffersUntilAvailable(t *testing.T) {
+	AppFs = afero.NewMemMapFs()
+	s := newRemoteWriteServer(t,
+		http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	defer s.Close()
+	w := newTestRemoteWriter(t, s.URL, "/var/lib/weather-station/remote-write")
+
+	w.write(testTime)
+
+	assert.Empty(t, s.requests)
+	files, _ := w.buffered()
+	assert.Len(t, files, 1)
+
+	w.write(testTime.Add(time.Minute))
+
+	require.Len(t, s.requests, 2)
+	assert.Equal(t, testTime.Unix()*1000, s.requests[0].Timeseries[0].Samples[0].Timestamp,
+		"Buffered request is sent first")
+	assert.Equal(t, testTime.Add(time.Minute).Unix()*1000, s.requests[1].Timeseries[0].Samples[0].Timestamp)
+	files, _ = w.buffered()
+	assert.Empty(t, files)
+}
+
+func TestRemoteWriter_bufferSize(t *testing.T) {
+	AppFs = afero.NewMemMapFs()
+	w := newTestRemoteWriter(t, "http://127.0.0.1:0/api/v1/write", "/var/lib/weather-station/remote-write")
+	w.config.Retries = 0
+
+	for i := 0; i < 3; i++ {
+		w.write(testTime.Add(time.Duration(i) * time.Minute))
+	}
+
+	files, _ := w.buffered()
+	require.Len(t, files, 2)
+	assert.Equal(t, "/var/lib/weather-station/remote-write/01570397428000000000.snappy", files[0],
+		"Oldest request is dropped")
+}
+
+func TestRemoteWriter_dropsRejectedRequests(t *testing.T) {
+	AppFs = afero.NewMemMapFs()
+	s := newRemoteWriteServer(t, http.StatusBadRequest)
+	defer s.Close()
+	w := newTestRemoteWriter(t, s.URL, "/var/lib/weather-station/remote-write")
+
+	w.write(testTime)
+
+	assert.Empty(t, s.requests)
+	files, _ := w.buffered()
+	assert.Empty(t, files, "Rejected request is not retried later")
+}
+
+func TestToTimeSeries_histogram(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	h := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "meter_interarrival_seconds",
+		Help:    "Time between two received transmissions of the sensor",
+		Buckets: []float64{30, 60},
+	})
+	h.Observe(45)
+	registry.MustRegister(h)
+	families, err := registry.Gather()
+	require.NoError(t, err)
+
+	series := toTimeSeries(families, testTime)
+
+	var names []string
+	for _, s := range series {
+		name := s.Labels[0].Value
+		if len(s.Labels) > 1 {
+			name += "{" + s.Labels[1].Name + "=" + s.Labels[1].Value + "}"
+		}
+		names = append(names, name)
+	}
+	assert.Equal(t, []string{
+		"meter_interarrival_seconds_bucket{le=30}",
+		"meter_interarrival_seconds_bucket{le=60}",
+		"meter_interarrival_seconds_bucket{le=+Inf}",
+		"meter_interarrival_seconds_sum",
+		"meter_interarrival_seconds_count",
+	}, names)
+	assert.Equal(t, 1.0, series[1].Samples[0].Value)
+	assert.Equal(t, 45.0, series[3].Samples[0].Value)
+}
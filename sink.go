@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Sink receives the readings of configured sensors from the dispatcher,
+// e.g. to export or publish them.
+type Sink interface {
+	// Name identifies the sink in its config and health metrics
+	Name() string
+	// Write handles a reading. Failed writes are retried, unless a permanentError is returned.
+	Write(r *Reading) error
+}
+
+// batchingSink is implemented by sinks whose Write only adds a reading to a batch. They
+// count the readings as written or failed themselves, once the batch has been written.
+type batchingSink interface {
+	Sink
+	batching()
+}
+
+// The policies for readings that don't fit into the queue of a sink.
+const (
+	// DropOldest drops the oldest queued reading to make room for the new one
+	DropOldest = "drop_oldest"
+	// DropNewest drops the new reading
+	DropNewest = "drop_newest"
+	// Block waits until the sink has caught up, which delays decoding further signals
+	Block = "block"
+)
+
+// SinkConfig configures how readings are queued and retried for a sink.
+type SinkConfig struct {
+	// QueueSize is the maximum number of readings waiting to be written
+	QueueSize int `mapstructure:"queue_size"`
+	// DropPolicy decides which reading is dropped if the queue is full:
+	// drop_oldest, drop_newest or block
+	DropPolicy string `mapstructure:"drop_policy"`
+	// Retries is the number of times a failed write is retried
+	Retries int `mapstructure:"retries"`
+	// Backoff is the delay before the first retry, which doubles with every retry
+	Backoff time.Duration `mapstructure:"backoff"`
+}
+
+// queuedSinks are the names of the sinks whose queues can be configured.
+// The Prometheus and textfile sinks are written synchronously, so that
+// the metrics are up to date as soon as a reading has been handled.
+var queuedSinks = []string{"mqtt", "influxdb", "graphite", "statsd", "store"}
+
+func (s SinkConfig) validate() ValidationErrors {
+	var errs ValidationErrors
+	if s.QueueSize <= 0 {
+		errs = append(errs, fmt.Errorf("queue size must be positive, got %d", s.QueueSize))
+	}
+	switch s.DropPolicy {
+	case DropOldest, DropNewest, Block:
+	default:
+		errs = append(errs, fmt.Errorf("invalid drop policy %q (supported: %s, %s, %s)",
+			s.DropPolicy, DropOldest, DropNewest, Block))
+	}
+	if s.Retries < 0 {
+		errs = append(errs, fmt.Errorf("retries must not be negative, got %d", s.Retries))
+	}
+	if s.Backoff < 0 {
+		errs = append(errs, fmt.Errorf("backoff must not be negative, got %v", s.Backoff))
+	}
+	return errs
+}
+
+func validateSinks(sinks map[string]SinkConfig) ValidationErrors {
+	known := map[string]bool{}
+	for _, name := range queuedSinks {
+		known[name] = true
+	}
+
+	names := make([]string, 0, len(sinks))
+	for name := range sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs ValidationErrors
+	for _, name := range names {
+		if !known[name] {
+			errs = append(errs, fmt.Errorf("sinks: unknown sink %q", name))
+			continue
+		}
+		for _, err := range sinks[name].validate() {
+			errs = append(errs, fmt.Errorf("sinks: %s: %v", name, err))
+		}
+	}
+	return errs
+}
+
+// sinkMetrics show the health of the sinks.
+type sinkMetrics struct {
+	readings    *prometheus.CounterVec
+	writeErrors *prometheus.CounterVec
+	queueLength *prometheus.GaugeVec
+	up          *prometheus.GaugeVec
+}
+
+func newSinkMetrics(r prometheus.Registerer, c MetricsConfig) *sinkMetrics {
+	labels := prometheus.Labels(c.Labels)
+	m := &sinkMetrics{
+		readings: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        c.metricName("sink_readings_total"),
+			Help:        "Number of readings handled by the sink by result (written, failed or dropped)",
+			ConstLabels: labels,
+		}, []string{"sink", "result"}),
+		writeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        c.metricName("sink_write_errors_total"),
+			Help:        "Number of failed attempts to write a reading, including retried ones",
+			ConstLabels: labels,
+		}, []string{"sink"}),
+		queueLength: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        c.metricName("sink_queue_length"),
+			Help:        "Number of readings waiting to be written by the sink",
+			ConstLabels: labels,
+		}, []string{"sink"}),
+		up: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        c.metricName("sink_up"),
+			Help:        "Whether the last reading has been written by the sink (1) or not (0)",
+			ConstLabels: labels,
+		}, []string{"sink"}),
+	}
+
+	r.MustRegister(m.readings, m.writeErrors, m.queueLength, m.up)
+	return m
+}
+
+// written counts readings that have been written by a sink, which is up.
+func (m *sinkMetrics) written(name string, n int) {
+	m.readings.WithLabelValues(name, "written").Add(float64(n))
+	m.up.WithLabelValues(name).Set(1)
+}
+
+// failed counts readings that a sink failed to write, which is down.
+func (m *sinkMetrics) failed(name string, n int) {
+	m.readings.WithLabelValues(name, "failed").Add(float64(n))
+	m.up.WithLabelValues(name).Set(0)
+}
+
+// dispatcher sends every reading to all sinks. Queued sinks are written by their own
+// goroutine, so that slow or unavailable sinks don't delay each other or decoding.
+type dispatcher struct {
+	metrics *sinkMetrics
+	sinks   []*sinkQueue
+	wg      sync.WaitGroup
+	// mu guards closed, so that no reading is queued after the queues have been closed
+	mu     sync.RWMutex
+	closed bool
+}
+
+// sinkQueue holds the readings of a sink, which is written synchronously if it has no queue.
+type sinkQueue struct {
+	sink     Sink
+	config   SinkConfig
+	readings chan *Reading
+	metrics  *sinkMetrics
+	// batched is set if the sink counts its written readings itself
+	batched bool
+	// ctx cancels blocked enqueues and retries once the dispatcher has been started
+	ctx context.Context
+}
+
+func newDispatcher(metrics *sinkMetrics) *dispatcher {
+	return &dispatcher{metrics: metrics}
+}
+
+// add adds a sink, which is written synchronously if the queue size is 0.
+func (d *dispatcher) add(s Sink, c SinkConfig) {
+	q := &sinkQueue{sink: s, config: c, metrics: d.metrics, ctx: context.Background()}
+	_, q.batched = s.(batchingSink)
+	if c.QueueSize > 0 {
+		q.readings = make(chan *Reading, c.QueueSize)
+	}
+	d.sinks = append(d.sinks, q)
+
+	d.metrics.queueLength.WithLabelValues(s.Name())
+	d.metrics.up.WithLabelValues(s.Name()).Set(1)
+	for _, result := range []string{"written", "failed", "dropped"} {
+		d.metrics.readings.WithLabelValues(s.Name(), result)
+	}
+	d.metrics.writeErrors.WithLabelValues(s.Name())
+}
+
+// start writes the queued readings until ctx is done or the dispatcher is closed.
+func (d *dispatcher) start(ctx context.Context) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, q := range d.sinks {
+		q.ctx = ctx
+		if q.readings == nil {
+			continue
+		}
+		d.wg.Add(1)
+		go func(q *sinkQueue) {
+			defer d.wg.Done()
+			q.run(ctx)
+		}(q)
+	}
+}
+
+// dispatch sends a reading to all sinks in the order they have been added.
+// Readings dispatched after the dispatcher has been closed are discarded.
+func (d *dispatcher) dispatch(r *Reading) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.closed {
+		return
+	}
+	for _, q := range d.sinks {
+		if q.readings == nil {
+			q.write(r)
+		} else {
+			q.enqueue(r)
+		}
+	}
+}
+
+// close writes the readings that are still queued and waits until all sinks are done.
+func (d *dispatcher) close() {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		for _, q := range d.sinks {
+			if q.readings != nil {
+				close(q.readings)
+			}
+		}
+	}
+	d.mu.Unlock()
+
+	d.wg.Wait()
+}
+
+func (q *sinkQueue) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case r, ok := <-q.readings:
+			if !ok {
+				return
+			}
+			q.metrics.queueLength.WithLabelValues(q.sink.Name()).Set(float64(len(q.readings)))
+			q.write(r)
+		}
+	}
+}
+
+// enqueue queues a reading, applying the drop policy if the queue is full.
+func (q *sinkQueue) enqueue(r *Reading) {
+	name := q.sink.Name()
+	defer func() {
+		q.metrics.queueLength.WithLabelValues(name).Set(float64(len(q.readings)))
+	}()
+
+	switch q.config.DropPolicy {
+	case Block:
+		select {
+		case q.readings <- r:
+		case <-q.ctx.Done():
+			q.metrics.readings.WithLabelValues(name, "dropped").Inc()
+		}
+	case DropNewest:
+		select {
+		case q.readings <- r:
+		default:
+			q.metrics.readings.WithLabelValues(name, "dropped").Inc()
+		}
+	default:
+		for {
+			select {
+			case q.readings <- r:
+				return
+			default:
+			}
+			select {
+			case <-q.readings:
+				q.metrics.readings.WithLabelValues(name, "dropped").Inc()
+			default:
+			}
+		}
+	}
+}
+
+// write writes a reading and retries it with exponential backoff, unless it is rejected
+// or the context of the dispatcher is done.
+func (q *sinkQueue) write(r *Reading) {
+	name := q.sink.Name()
+	err := retryContext(q.ctx, q.config.Retries, q.config.Backoff, func() error {
+		err := q.sink.Write(r)
+		if err != nil {
+			q.metrics.writeErrors.WithLabelValues(name).Inc()
+		}
+		return err
+	})
+
+	if err != nil {
+		log.Println(err)
+		q.metrics.failed(name, 1)
+		return
+	}
+	if !q.batched {
+		q.metrics.written(name, 1)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSink records written readings and fails with the given errors first.
+type fakeSink struct {
+	sync.Mutex
+	errs     []error
+	readings []*Reading
+	// blocked delays writes until it is closed (if set)
+	blocked chan struct{}
+}
+
+func (s *fakeSink) Name() string {
+	return "fake"
+}
+
+func (s *fakeSink) Write(r *Reading) error {
+	if s.blocked != nil {
+		<-s.blocked
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.errs) > 0 {
+		err := s.errs[0]
+		s.errs = s.errs[1:]
+		return err
+	}
+	s.readings = append(s.readings, r)
+	return nil
+}
+
+func (s *fakeSink) temperatures() []float64 {
+	s.Lock()
+	defer s.Unlock()
+
+	var temperatures []float64
+	for _, r := range s.readings {
+		temperatures = append(temperatures, r.Temperature)
+	}
+	return temperatures
+}
+
+func newTestDispatcher(t *testing.T) (*dispatcher, *prometheus.Registry) {
+	registry := prometheus.NewRegistry()
+	return newDispatcher(newSinkMetrics(registry, MetricsConfig{Namespace: "meter"})), registry
+}
+
+// sinkMetric returns the value of a health metric of the fake sink.
+func sinkMetric(t *testing.T, registry *prometheus.Registry, name string, result string) float64 {
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			matches := true
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "result" && l.GetValue() != result {
+					matches = false
+				}
+			}
+			if !matches {
+				continue
+			}
+			if m.GetCounter() != nil {
+				return m.GetCounter().GetValue()
+			}
+			return m.GetGauge().GetValue()
+		}
+	}
+	t.Fatalf("Metric %s not found", name)
+	return 0
+}
+
+func TestDispatcher_synchronous(t *testing.T) {
+	d, registry := newTestDispatcher(t)
+	s := &fakeSink{}
+	d.add(s, SinkConfig{})
+
+	d.dispatch(testReading(4.2))
+
+	assert.Equal(t, []float64{4.2}, s.temperatures(), "Written without starting the dispatcher")
+	assert.Equal(t, 1.0, sinkMetric(t, registry, "meter_sink_readings_total", "written"))
+	assert.Equal(t, 1.0, sinkMetric(t, registry, "meter_sink_up", ""))
+}
+
+func TestDispatcher_queued(t *testing.T) {
+	d, _ := newTestDispatcher(t)
+	s := &fakeSink{}
+	d.add(s, SinkConfig{QueueSize: 10, DropPolicy: DropOldest})
+	d.start(context.Background())
+
+	d.dispatch(testReading(4.2))
+	d.dispatch(testReading(4.3))
+	d.close()
+
+	assert.Equal(t, []float64{4.2, 4.3}, s.temperatures(), "Queued readings are written on close")
+}
+
+func TestDispatcher_slowSinkDoesNotDelayOthers(t *testing.T) {
+	d, _ := newTestDispatcher(t)
+	slow := &fakeSink{blocked: make(chan struct{})}
+	fast := &fakeSink{}
+	d.add(slow, SinkConfig{QueueSize: 10, DropPolicy: Block})
+	d.add(fast, SinkConfig{})
+	d.start(context.Background())
+
+	d.dispatch(testReading(4.2))
+
+	assert.Equal(t, []float64{4.2}, fast.temperatures())
+	assert.Empty(t, slow.temperatures())
+
+	close(slow.blocked)
+	d.close()
+	assert.Equal(t, []float64{4.2}, slow.temperatures())
+}
+
+func TestDispatcher_dropPolicies(t *testing.T) {
+	for policy, expected := range map[string][]float64{
+		DropOldest: {4.3, 4.4},
+		DropNewest: {4.2, 4.3},
+	} {
+		t.Run(policy, func(t *testing.T) {
+			d, registry := newTestDispatcher(t)
+			s := &fakeSink{}
+			d.add(s, SinkConfig{QueueSize: 2, DropPolicy: policy})
+
+			// the queue is full, as the dispatcher has not been started
+			d.dispatch(testReading(4.2))
+			d.dispatch(testReading(4.3))
+			d.dispatch(testReading(4.4))
+			assert.Equal(t, 2.0, sinkMetric(t, registry, "meter_sink_queue_length", ""))
+
+			d.start(context.Background())
+			d.close()
+
+			assert.Equal(t, expected, s.temperatures())
+			assert.Equal(t, 1.0, sinkMetric(t, registry, "meter_sink_readings_total", "dropped"))
+		})
+	}
+}
+
+func TestDispatcher_retries(t *testing.T) {
+	d, registry := newTestDispatcher(t)
+	s := &fakeSink{errs: []error{errors.New("unavailable"), errors.New("unavailable")}}
+	d.add(s, SinkConfig{Retries: 2, Backoff: time.Millisecond})
+
+	d.dispatch(testReading(4.2))
+
+	assert.Equal(t, []float64{4.2}, s.temperatures())
+	assert.Equal(t, 2.0, sinkMetric(t, registry, "meter_sink_write_errors_total", ""))
+	assert.Equal(t, 1.0, sinkMetric(t, registry, "meter_sink_readings_total", "written"))
+}
+
+func TestDispatcher_failed(t *testing.T) {
+	d, registry := newTestDispatcher(t)
+	s := &fakeSink{errs: []error{permanentError{errors.New("rejected")}}}
+	d.add(s, SinkConfig{Retries: 2, Backoff: time.Millisecond})
+
+	d.dispatch(testReading(4.2))
+
+	assert.Empty(t, s.temperatures())
+	assert.Equal(t, 1.0, sinkMetric(t, registry, "meter_sink_write_errors_total", ""),
+		"Rejected reading is not retried")
+	assert.Equal(t, 1.0, sinkMetric(t, registry, "meter_sink_readings_total", "failed"))
+	assert.Equal(t, 0.0, sinkMetric(t, registry, "meter_sink_up", ""))
+}
+
+func TestDispatcher_dispatchAfterClose(t *testing.T) {
+	d, _ := newTestDispatcher(t)
+	s := &fakeSink{}
+	d.add(s, SinkConfig{QueueSize: 10, DropPolicy: Block})
+	d.start(context.Background())
+	d.close()
+
+	assert.NotPanics(t, func() { d.dispatch(testReading(4.2)) })
+	assert.Empty(t, s.temperatures())
+	assert.NotPanics(t, d.close, "Closing twice")
+}
+
+func TestDispatcher_blockCancelled(t *testing.T) {
+	d, registry := newTestDispatcher(t)
+	s := &fakeSink{blocked: make(chan struct{})}
+	defer close(s.blocked)
+	d.add(s, SinkConfig{QueueSize: 1, DropPolicy: Block})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d.start(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		// at most two readings fit into the queue and the blocked sink
+		d.dispatch(testReading(4.2))
+		d.dispatch(testReading(4.3))
+		d.dispatch(testReading(4.4))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Dispatch still blocked after the context is done")
+	}
+	assert.True(t, sinkMetric(t, registry, "meter_sink_readings_total", "dropped") >= 1)
+}
+
+func TestDispatcher_retryCancelled(t *testing.T) {
+	d, registry := newTestDispatcher(t)
+	s := &fakeSink{errs: []error{errors.New("unavailable"), errors.New("unavailable")}}
+	d.add(s, SinkConfig{Retries: 2, Backoff: time.Hour})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d.start(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		d.dispatch(testReading(4.2))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Retry still waiting after the context is done")
+	}
+	assert.Equal(t, 1.0, sinkMetric(t, registry, "meter_sink_write_errors_total", ""))
+	assert.Equal(t, 1.0, sinkMetric(t, registry, "meter_sink_readings_total", "failed"))
+}
+
+func TestParseConfig_sinks(t *testing.T) {
+	c, err := parseConfigString(`
+sinks:
+  mqtt:
+    queue_size: 10
+    drop_policy: block
+`)
+	require.NoError(t, err)
+
+	assert.Equal(t, SinkConfig{QueueSize: 10, DropPolicy: Block, Retries: 3, Backoff: time.Second}, c.Sinks["mqtt"])
+	assert.Equal(t, SinkConfig{QueueSize: 1000, DropPolicy: DropOldest, Retries: 3, Backoff: time.Second},
+		c.Sinks["influxdb"])
+}
+
+func TestParseConfig_invalidSinks(t *testing.T) {
+	_, err := parseConfigString(`
+sinks:
+  kafka:
+    queue_size: 10
+  graphite:
+    queue_size: 0
+    drop_policy: drop_random
+`)
+
+	assert.EqualError(t, err, "sinks: graphite: queue size must be positive, got 0; "+
+		`sinks: graphite: invalid drop policy "drop_random" (supported: drop_oldest, drop_newest, block); `+
+		`sinks: unknown sink "kafka"`)
+}
+
+func TestParseConfig_sinkLabelsReserved(t *testing.T) {
+	_, err := parseConfigString(`
+metrics:
+  labels:
+    sink: pi
+    result: ok
+`)
+
+	assert.EqualError(t, err, `metrics labels: label name "result" is reserved; `+
+		`metrics labels: label name "sink" is reserved`)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// StatsDConfig configures sending readings as StatsD gauges.
+type StatsDConfig struct {
+	// Address is the host:port of the StatsD server (sending is disabled if not set)
+	Address string `mapstructure:"address"`
+	// PathTemplate is the name of the gauges, e.g. weather.{location}.{quantity}
+	PathTemplate pathTemplate `mapstructure:"path_template"`
+}
+
+func (s StatsDConfig) validate() ValidationErrors {
+	var errs ValidationErrors
+	if s.Address == "" {
+		return errs
+	}
+
+	if _, _, err := net.SplitHostPort(s.Address); err != nil {
+		errs = append(errs, fmt.Errorf("statsd: invalid address %q", s.Address))
+	}
+	if err := s.PathTemplate.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("statsd: %v", err))
+	}
+	return errs
+}
+
+// statsdOutput sends the quantities of readings as gauges over UDP.
+type statsdOutput struct {
+	config StatsDConfig
+}
+
+func newStatsDOutput(c StatsDConfig) *statsdOutput {
+	return &statsdOutput{config: c}
+}
+
+// Name identifies the StatsD output as sink.
+func (o *statsdOutput) Name() string {
+	return "statsd"
+}
+
+// Write sends all quantities of a reading in a single packet.
+func (o *statsdOutput) Write(r *Reading) error {
+	var b bytes.Buffer
+	for _, q := range quantities(r) {
+		name := o.config.PathTemplate.path(r.Sensor, q.name)
+		if q.value < 0 {
+			// a signed value changes the gauge by the value instead
+			// of setting it, so it needs to be reset first
+			fmt.Fprintf(&b, "%s:0|g\n", name)
+		}
+		fmt.Fprintf(&b, "%s:%s|g\n", name, formatFloat(q.value))
+	}
+
+	return o.write(b.Bytes())
+}
+
+func (o *statsdOutput) write(data []byte) error {
+	conn, err := net.Dial("udp", o.config.Address)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to send to StatsD '%s'", o.config.Address)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(data)
+	return errors.Wrapf(err, "Failed to send to StatsD '%s'", o.config.Address)
+}
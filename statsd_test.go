@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsDOutput(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	o := newStatsDOutput(StatsDConfig{
+		Address:      conn.LocalAddr().String(),
+		PathTemplate: "weather.{location}.{quantity}",
+	})
+
+	require.NoError(t, o.Write(testReading(-4.2)))
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "weather.fridge.temperature:0|g\n"+
+		"weather.fridge.temperature:-4.2|g\n"+
+		"weather.fridge.humidity:60|g\n"+
+		"weather.fridge.low_battery:0|g\n", string(buf[:n]))
+}
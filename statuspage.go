@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// sparklineWidth and sparklineHeight are the size of the sparklines in pixels
+	// (as in statusPageTemplate)
+	sparklineWidth  = 160
+	sparklineHeight = 32
+	// sparklineWindow is the time shown by the sparklines
+	sparklineWindow = 24 * time.Hour
+)
+
+// deviceState is the connection state of the Arduino.
+type deviceState struct {
+	sync.Mutex
+	path      string
+	connected bool
+	since     time.Time
+}
+
+func (d *deviceState) set(path string, connected bool, now time.Time) {
+	d.Lock()
+	defer d.Unlock()
+
+	if path != "" {
+		d.path = path
+	}
+	d.connected = connected
+	d.since = now
+}
+
+// DeviceConnected marks the Arduino with the given path as connected, e.g. for the status page.
+func (e *Exporter) DeviceConnected(path string) {
+	e.device.set(path, true, time.Now())
+}
+
+// statusPage is rendered by statusPageTemplate.
+type statusPage struct {
+	Device  deviceStatus
+	Sensors []sensorRow
+}
+
+type deviceStatus struct {
+	Path      string
+	Connected bool
+	Since     string
+}
+
+type sensorRow struct {
+	SensorStatus
+	Age                  string
+	TemperatureSparkline string
+	HumiditySparkline    string
+}
+
+var statusPageTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"float": func(f *float64, unit string) string {
+		if f == nil {
+			return "–"
+		}
+		return fmt.Sprintf("%.1f %s", *f, unit)
+	},
+	"deref": func(b *bool) bool {
+		return *b
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta http-equiv="refresh" content="60">
+<title>Weather Station</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; }
+th, td { padding: 0.4em 0.8em; text-align: left; border-bottom: 1px solid #ddd; }
+td.number { text-align: right; }
+.ok { color: #2a7d2a; }
+.problem { color: #c0392b; font-weight: bold; }
+.stale td { color: #999; }
+svg polyline { fill: none; stroke-width: 1.5; }
+.temperature polyline { stroke: #c0392b; }
+.humidity polyline { stroke: #2471a3; }
+</style>
+</head>
+<body>
+<h1>Weather Station</h1>
+<p>Arduino {{with .Device.Path}}<code>{{.}}</code> {{end}}
+{{- if .Device.Connected}}<span class="ok">connected</span>{{else}}<span class="problem">disconnected</span>{{end}}
+{{- with .Device.Since}} since {{.}}{{end}}</p>
+<table>
+<tr><th>Location</th><th>ID</th><th>Temperature</th><th></th><th>Humidity</th><th></th><th>Battery</th><th>Last seen</th></tr>
+{{- range .Sensors}}
+<tr{{if .Stale}} class="stale"{{end}}>
+<td>{{.Location}}</td>
+<td>{{.ID}}</td>
+<td class="number">{{float .Temperature "°C"}}</td>
+<td class="temperature">{{with .TemperatureSparkline}}<svg width="160" height="32" viewBox="0 0 160 32"><polyline points="{{.}}"/></svg>{{end}}</td>
+<td class="number">{{float .Humidity "%"}}</td>
+<td class="humidity">{{with .HumiditySparkline}}<svg width="160" height="32" viewBox="0 0 160 32"><polyline points="{{.}}"/></svg>{{end}}</td>
+<td>{{if .LowBattery}}{{if deref .LowBattery}}<span class="problem">low</span>{{else}}<span class="ok">ok</span>{{end}}{{else}}–{{end}}</td>
+<td>{{if .Age}}{{.Age}} ago{{else}}never{{end}}</td>
+</tr>
+{{- end}}
+</table>
+<p>Last 24 hours. <a href="/metrics">Metrics</a> · <a href="/api/sensors">JSON</a></p>
+</body>
+</html>
+`))
+
+// statusPageHandler serves an HTML page with the latest values of all sensors,
+// sparklines of the last 24 hours and whether the Arduino is connected.
+func (e *Exporter) statusPageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	now := time.Now()
+	var page statusPage
+
+	e.device.Lock()
+	page.Device = deviceStatus{Path: e.device.path, Connected: e.device.connected}
+	if !e.device.since.IsZero() {
+		page.Device.Since = e.device.since.Format("2006-01-02 15:04:05")
+	}
+	e.device.Unlock()
+
+	for _, id := range e.config.SensorIDs() {
+		row := sensorRow{SensorStatus: sensorStatus(e.config.Sensors[id], e.readings.Get(id), now)}
+		if row.LastSeen != nil {
+			row.Age = now.Sub(*row.LastSeen).Round(time.Second).String()
+		}
+
+		start := now.Add(-sparklineWindow)
+		buckets := e.sparklineBuckets(id, start, now)
+		row.TemperatureSparkline = sparkline(buckets, start, func(b HistoryBucket) float64 { return b.Temperature.Avg })
+		row.HumiditySparkline = sparkline(buckets, start, func(b HistoryBucket) float64 { return b.Humidity.Avg })
+		page.Sensors = append(page.Sensors, row)
+	}
+
+	var buf bytes.Buffer
+	if err := statusPageTemplate.Execute(&buf, page); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if _, err := buf.WriteTo(w); err != nil {
+		log.Println(err)
+	}
+}
+
+// sparklineBuckets returns the readings of a sensor between start and end averaged per pixel, however many
+// are kept. They are read from the store if configured, so that the sparklines survive restarts.
+func (e *Exporter) sparklineBuckets(id string, start, end time.Time) []HistoryBucket {
+	step := sparklineWindow / sparklineWidth
+	if e.store == nil {
+		return downsample(e.history.Get(id, start, end), start, step)
+	}
+
+	buckets, points, err := e.store.Get(id, start, end)
+	if err != nil {
+		log.Println(err)
+		return downsample(e.history.Get(id, start, end), start, step)
+	}
+	// buckets of the store can't be split into smaller ones
+	if e.config.Store.Step <= step {
+		buckets = mergeBuckets(buckets, start, step)
+	}
+	return append(buckets, downsample(points, start, step)...)
+}
+
+// sparkline returns the points of an SVG polyline of the values of the buckets within sparklineWindow
+// from start on, scaled to the size of the sparkline, or nothing for less than two buckets.
+func sparkline(buckets []HistoryBucket, start time.Time, value func(HistoryBucket) float64) string {
+	if len(buckets) < 2 {
+		return ""
+	}
+
+	min, max := math.Inf(1), math.Inf(-1)
+	for _, b := range buckets {
+		min = math.Min(min, value(b))
+		max = math.Max(max, value(b))
+	}
+	if max == min {
+		// draw a flat line in the middle
+		min, max = min-1, max+1
+	}
+
+	coordinates := make([]string, len(buckets))
+	for i, b := range buckets {
+		x := b.Time.Sub(start).Seconds() / sparklineWindow.Seconds() * sparklineWidth
+		// leave a pixel at the top and bottom for the stroke
+		y := 1 + (max-value(b))/(max-min)*(sparklineHeight-2)
+		coordinates[i] = fmt.Sprintf("%.1f,%.1f", x, y)
+	}
+	return strings.Join(coordinates, " ")
+}
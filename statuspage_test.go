@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusPageHandler(t *testing.T) {
+	e := newTestAPIExporter(t)
+	e.DeviceConnected("/dev/ttyUSB0")
+	now := time.Now()
+	e.handleReading(&Reading{Sensor: e.config.Sensors["91"], Temperature: 4.2, Humidity: 60, Time: now.Add(-time.Hour)})
+	e.handleReading(&Reading{Sensor: e.config.Sensors["91"], Temperature: 4.8, Humidity: 58, LowBattery: true,
+		Time: now.Add(-90 * time.Second)})
+
+	w := get(e, "/")
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	body := w.Body.String()
+	assert.Contains(t, body, "<code>/dev/ttyUSB0</code> <span class=\"ok\">connected</span>")
+	assert.Contains(t, body, "<td>fridge</td>")
+	assert.Contains(t, body, "<td class=\"number\">4.8 °C</td>")
+	assert.Contains(t, body, "<td class=\"number\">58.0 %</td>")
+	assert.Contains(t, body, "<span class=\"problem\">low</span>")
+	assert.Contains(t, body, "<td>1m30s ago</td>")
+	assert.Contains(t, body, "<polyline points=\"", "Sparkline of the history")
+	assert.Contains(t, body, "<td>garden</td>")
+	assert.Contains(t, body, "<td>never</td>")
+	assert.NotContains(t, body, "<script")
+
+	e.Close()
+	assert.Contains(t, get(e, "/").Body.String(), "<span class=\"problem\">disconnected</span>")
+}
+
+func TestStatusPageHandler_store(t *testing.T) {
+	dir, err := ioutil.TempDir("", "weather-station")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := parseConfigString(`
+store:
+  path: ` + filepath.Join(dir, "readings.db") + `
+sensors:
+  91:
+    location: fridge
+    protocol: weather12
+`)
+	require.NoError(t, err)
+	e := newTestExporter(t, c)
+	defer e.store.Close()
+
+	// readings stored before a restart aren't in the in-memory history
+	now := time.Now()
+	require.NoError(t, e.store.Write(&Reading{Sensor: c.Sensors["91"], Temperature: 4.2, Humidity: 60,
+		Time: now.Add(-2 * time.Hour)}))
+	require.NoError(t, e.store.Write(&Reading{Sensor: c.Sensors["91"], Temperature: 4.8, Humidity: 58,
+		Time: now.Add(-time.Hour)}))
+
+	assert.Contains(t, get(e, "/").Body.String(), "<polyline points=\"", "Sparkline of the stored readings")
+}
+
+func TestStatusPageHandler_notFound(t *testing.T) {
+	e := newTestAPIExporter(t)
+
+	assert.Equal(t, http.StatusNotFound, get(e, "/favicon.ico").Code)
+}
+
+func TestSparkline(t *testing.T) {
+	start := testTime.Add(-sparklineWindow)
+	buckets := []HistoryBucket{
+		{Time: start, Temperature: HistoryAggregate{Avg: 10}},
+		{Time: start.Add(sparklineWindow / 2), Temperature: HistoryAggregate{Avg: 20}},
+		{Time: testTime, Temperature: HistoryAggregate{Avg: 15}},
+	}
+
+	temperature := func(b HistoryBucket) float64 { return b.Temperature.Avg }
+	assert.Equal(t, "0.0,31.0 80.0,1.0 160.0,16.0", sparkline(buckets, start, temperature))
+	assert.Equal(t, "", sparkline(buckets[:1], start, temperature), "A single point isn't a line")
+	buckets[1].Temperature.Avg = 10
+	assert.Equal(t, "0.0,16.0 80.0,16.0", sparkline(buckets[:2], start, temperature),
+		"Constant values are drawn in the middle")
+}
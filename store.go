@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// storeCompactInterval is the time between downsampling and expiring old readings in the store.
+const storeCompactInterval = time.Hour
+
+var (
+	// readingsBucket holds a bucket per sensor with the readings keyed by time
+	readingsBucket = []byte("readings")
+	// downsampledBucket holds a bucket per sensor with the aggregated old readings keyed by time
+	downsampledBucket = []byte("downsampled")
+)
+
+// StoreConfig configures the database file persisting the readings.
+type StoreConfig struct {
+	// Path is the database file (the store is disabled if not set)
+	Path string `mapstructure:"path"`
+	// Retention is the time readings are kept at all
+	Retention time.Duration `mapstructure:"retention"`
+	// RawRetention is the time every reading is kept before it is downsampled
+	RawRetention time.Duration `mapstructure:"raw_retention"`
+	// Step is the duration of the buckets old readings are downsampled to
+	Step time.Duration `mapstructure:"step"`
+}
+
+func (s StoreConfig) validate() ValidationErrors {
+	var errs ValidationErrors
+	if s.Path == "" {
+		return errs
+	}
+
+	if s.Retention <= 0 {
+		errs = append(errs, fmt.Errorf("store: retention must be positive, got %v", s.Retention))
+	}
+	if s.RawRetention <= 0 || s.RawRetention > s.Retention {
+		errs = append(errs, fmt.Errorf("store: raw retention must be positive and not exceed the retention, got %v",
+			s.RawRetention))
+	}
+	if s.Step <= 0 {
+		errs = append(errs, fmt.Errorf("store: step must be positive, got %v", s.Step))
+	}
+	return errs
+}
+
+// Store persists the readings of all sensors in a database file, so that the
+// history survives restarts. Readings older than the raw retention are downsampled
+// into buckets, which are kept until the retention.
+type Store struct {
+	config StoreConfig
+	db     *bolt.DB
+}
+
+// storedBucket is the binary encoding of a HistoryBucket in the store.
+type storedBucket struct {
+	Count                                          uint64
+	TemperatureMin, TemperatureMax, TemperatureAvg float64
+	HumidityMin, HumidityMax, HumidityAvg          float64
+}
+
+// storedPoint is the binary encoding of a HistoryPoint in the store.
+type storedPoint struct {
+	Temperature, Humidity float64
+}
+
+// OpenStore opens or creates the database file of the store.
+func OpenStore(c StoreConfig) (*Store, error) {
+	db, err := bolt.Open(c.Path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to open store '%s'", c.Path)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{readingsBucket, downsampledBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrapf(err, "Failed to initialize store '%s'", c.Path)
+	}
+	return &Store{config: c, db: db}, nil
+}
+
+// Name identifies the store as sink.
+func (s *Store) Name() string {
+	return "store"
+}
+
+// Write persists a reading.
+func (s *Store) Write(r *Reading) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(readingsBucket).CreateBucketIfNotExists([]byte(r.Sensor.ID))
+		if err != nil {
+			return err
+		}
+		return b.Put(storeKey(r.Time), encodeStored(storedPoint{r.Temperature, r.Humidity}))
+	})
+	return errors.Wrapf(err, "Failed to write reading to store '%s'", s.config.Path)
+}
+
+// Get returns the history of a sensor between from and to (both inclusive), oldest first:
+// the downsampled buckets of old readings and the readings that have not been downsampled yet.
+func (s *Store) Get(id string, from, to time.Time) ([]HistoryBucket, []HistoryPoint, error) {
+	var buckets []HistoryBucket
+	var points []HistoryPoint
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		err := scanStore(tx.Bucket(downsampledBucket).Bucket([]byte(id)), from, to, func(t time.Time, v []byte) error {
+			var stored storedBucket
+			if err := decodeStored(v, &stored); err != nil {
+				return err
+			}
+			buckets = append(buckets, stored.bucket(t))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return scanStore(tx.Bucket(readingsBucket).Bucket([]byte(id)), from, to, func(t time.Time, v []byte) error {
+			var stored storedPoint
+			if err := decodeStored(v, &stored); err != nil {
+				return err
+			}
+			points = append(points, HistoryPoint{Time: t, Temperature: stored.Temperature, Humidity: stored.Humidity})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "Failed to read history of sensor %s from store '%s'", id, s.config.Path)
+	}
+	return buckets, points, nil
+}
+
+// run periodically downsamples and expires old readings until ctx is done.
+func (s *Store) run(ctx context.Context) {
+	ticker := time.NewTicker(storeCompactInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.compact(time.Now()); err != nil {
+			log.Println(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// compact downsamples the readings older than the raw retention into buckets of the configured step
+// and deletes buckets older than the retention. Only complete buckets are downsampled.
+func (s *Store) compact(now time.Time) error {
+	// buckets are aligned to the epoch like by downsample, whereas Truncate aligns them to the zero time
+	epoch := time.Unix(0, 0).UTC()
+	rawEnd := epoch.Add(now.Add(-s.config.RawRetention).Sub(epoch) / s.config.Step * s.config.Step)
+	end := now.Add(-s.config.Retention)
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		// buckets must not be modified while iterating over them
+		var ids [][]byte
+		err := tx.Bucket(readingsBucket).ForEach(func(id, _ []byte) error {
+			ids = append(ids, append([]byte{}, id...))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			if err := s.compactSensor(tx, id, rawEnd, end); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return errors.Wrapf(err, "Failed to downsample readings in store '%s'", s.config.Path)
+}
+
+// compactSensor downsamples the readings of a sensor before rawEnd and deletes its buckets before end.
+func (s *Store) compactSensor(tx *bolt.Tx, id []byte, rawEnd, end time.Time) error {
+	epoch := time.Unix(0, 0).UTC()
+
+	raw := tx.Bucket(readingsBucket).Bucket(id)
+	var old []HistoryPoint
+	err := scanStore(raw, epoch, rawEnd.Add(-1), func(t time.Time, v []byte) error {
+		var stored storedPoint
+		if err := decodeStored(v, &stored); err != nil {
+			return err
+		}
+		old = append(old, HistoryPoint{Time: t, Temperature: stored.Temperature, Humidity: stored.Humidity})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, p := range old {
+		if err := raw.Delete(storeKey(p.Time)); err != nil {
+			return err
+		}
+	}
+
+	b, err := tx.Bucket(downsampledBucket).CreateBucketIfNotExists(id)
+	if err != nil {
+		return err
+	}
+	for _, bucket := range downsample(old, epoch, s.config.Step) {
+		key := storeKey(bucket.Time)
+		// readings might have arrived late for an already downsampled bucket
+		if v := b.Get(key); v != nil {
+			var stored storedBucket
+			if err := decodeStored(v, &stored); err != nil {
+				return err
+			}
+			existing := stored.bucket(bucket.Time)
+			existing.merge(bucket)
+			bucket = existing
+		}
+		if err := b.Put(key, encodeStored(newStoredBucket(bucket))); err != nil {
+			return err
+		}
+	}
+
+	var expired []time.Time
+	err = scanStore(b, epoch, end.Add(-1), func(t time.Time, _ []byte) error {
+		expired = append(expired, t)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, t := range expired {
+		if err := b.Delete(storeKey(t)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the database file.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// scanStore calls f with the time and value of all entries of b between from and to (both inclusive).
+// A missing bucket has no entries.
+func scanStore(b *bolt.Bucket, from, to time.Time, f func(t time.Time, v []byte) error) error {
+	if b == nil {
+		return nil
+	}
+	// keys can't represent times before the epoch
+	epoch := time.Unix(0, 0)
+	if to.Before(epoch) {
+		return nil
+	}
+	if from.Before(epoch) {
+		from = epoch
+	}
+
+	max := storeKey(to)
+	c := b.Cursor()
+	for k, v := c.Seek(storeKey(from)); k != nil && bytes.Compare(k, max) <= 0; k, v = c.Next() {
+		if err := f(time.Unix(0, int64(binary.BigEndian.Uint64(k))).UTC(), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storeKey encodes a time as key, which sorts in chronological order (from 1970 on).
+func storeKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return key
+}
+
+// encodeStored encodes a storedPoint or storedBucket.
+func encodeStored(v interface{}) []byte {
+	var buf bytes.Buffer
+	// writing fixed-size values to a buffer can't fail
+	binary.Write(&buf, binary.BigEndian, v)
+	return buf.Bytes()
+}
+
+// decodeStored decodes a storedPoint or storedBucket.
+func decodeStored(data []byte, v interface{}) error {
+	return binary.Read(bytes.NewReader(data), binary.BigEndian, v)
+}
+
+func newStoredBucket(b HistoryBucket) storedBucket {
+	return storedBucket{
+		Count:          uint64(b.Count),
+		TemperatureMin: b.Temperature.Min,
+		TemperatureMax: b.Temperature.Max,
+		TemperatureAvg: b.Temperature.Avg,
+		HumidityMin:    b.Humidity.Min,
+		HumidityMax:    b.Humidity.Max,
+		HumidityAvg:    b.Humidity.Avg,
+	}
+}
+
+func (s storedBucket) bucket(t time.Time) HistoryBucket {
+	return HistoryBucket{
+		Time:        t,
+		Count:       int(s.Count),
+		Temperature: HistoryAggregate{Min: s.TemperatureMin, Max: s.TemperatureMax, Avg: s.TemperatureAvg},
+		Humidity:    HistoryAggregate{Min: s.HumidityMin, Max: s.HumidityMax, Avg: s.HumidityAvg},
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// openTestStore opens a store in a temporary directory, which is removed by the returned function.
+func openTestStore(t *testing.T, c StoreConfig) (*Store, func()) {
+	dir, err := ioutil.TempDir("", "weather-station")
+	require.NoError(t, err)
+
+	c.Path = filepath.Join(dir, "readings.db")
+	s, err := OpenStore(c)
+	require.NoError(t, err)
+	return s, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestStore(t *testing.T) {
+	s, cleanup := openTestStore(t, StoreConfig{})
+	defer cleanup()
+	sensor := &SensorConfig{ID: "91"}
+
+	require.NoError(t, s.Write(&Reading{Sensor: sensor, Temperature: 4.2, Humidity: 60, Time: testTime}))
+	require.NoError(t, s.Write(&Reading{Sensor: sensor, Temperature: 4.5, Humidity: 58, Time: testTime.Add(time.Minute)}))
+	require.NoError(t, s.Write(&Reading{Sensor: sensor, Temperature: 5, Humidity: 55, Time: testTime.Add(time.Hour)}))
+
+	buckets, points, err := s.Get("91", testTime, testTime.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Empty(t, buckets)
+	assert.Equal(t, []HistoryPoint{
+		{Time: testTime, Temperature: 4.2, Humidity: 60},
+		{Time: testTime.Add(time.Minute), Temperature: 4.5, Humidity: 58},
+	}, points)
+
+	_, points, err = s.Get("92", testTime, testTime.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, points)
+
+	_, points, err = s.Get("91", time.Unix(-3600, 0), time.Unix(-1, 0))
+	require.NoError(t, err)
+	assert.Empty(t, points, "Times before the epoch have no readings")
+}
+
+func TestStore_persists(t *testing.T) {
+	s, cleanup := openTestStore(t, StoreConfig{})
+	defer cleanup()
+	require.NoError(t, s.Write(&Reading{Sensor: &SensorConfig{ID: "91"}, Temperature: 4.2, Humidity: 60, Time: testTime}))
+	require.NoError(t, s.Close())
+
+	s, err := OpenStore(s.config)
+	require.NoError(t, err)
+	defer s.Close()
+
+	_, points, err := s.Get("91", testTime, testTime)
+	require.NoError(t, err)
+	assert.Equal(t, []HistoryPoint{{Time: testTime, Temperature: 4.2, Humidity: 60}}, points)
+}
+
+func TestStore_compact(t *testing.T) {
+	s, cleanup := openTestStore(t, StoreConfig{Retention: 48 * time.Hour, RawRetention: 24 * time.Hour, Step: time.Hour})
+	defer cleanup()
+	sensor := &SensorConfig{ID: "91"}
+	hour := testTime.Truncate(time.Hour)
+	now := hour.Add(24*time.Hour + 30*time.Minute)
+
+	for _, r := range []*Reading{
+		// expired
+		{Time: hour.Add(-25 * time.Hour), Temperature: 1, Humidity: 40},
+		// downsampled
+		{Time: hour.Add(-time.Hour), Temperature: 3, Humidity: 50},
+		{Time: hour.Add(-30 * time.Minute), Temperature: 5, Humidity: 70},
+		// the bucket from hour on is not complete yet
+		{Time: hour, Temperature: 7, Humidity: 80},
+		{Time: hour.Add(45 * time.Minute), Temperature: 8, Humidity: 90},
+	} {
+		r.Sensor = sensor
+		require.NoError(t, s.Write(r))
+	}
+
+	require.NoError(t, s.compact(now))
+
+	buckets, points, err := s.Get("91", hour.Add(-48*time.Hour), now)
+	require.NoError(t, err)
+	assert.Equal(t, []HistoryBucket{{
+		Time:        hour.Add(-time.Hour),
+		Count:       2,
+		Temperature: HistoryAggregate{Min: 3, Max: 5, Avg: 4},
+		Humidity:    HistoryAggregate{Min: 50, Max: 70, Avg: 60},
+	}}, buckets)
+	assert.Equal(t, []HistoryPoint{
+		{Time: hour, Temperature: 7, Humidity: 80},
+		{Time: hour.Add(45 * time.Minute), Temperature: 8, Humidity: 90},
+	}, points)
+
+	// a late reading is merged into its downsampled bucket
+	require.NoError(t, s.Write(&Reading{Sensor: sensor, Temperature: 10, Humidity: 60, Time: hour.Add(-15 * time.Minute)}))
+	require.NoError(t, s.compact(now))
+
+	buckets, _, err = s.Get("91", hour.Add(-48*time.Hour), now)
+	require.NoError(t, err)
+	assert.Equal(t, []HistoryBucket{{
+		Time:        hour.Add(-time.Hour),
+		Count:       3,
+		Temperature: HistoryAggregate{Min: 3, Max: 10, Avg: 6},
+		Humidity:    HistoryAggregate{Min: 50, Max: 70, Avg: 60},
+	}}, buckets)
+
+	// downsampled readings expire after the retention
+	require.NoError(t, s.compact(now.Add(48*time.Hour)))
+
+	buckets, points, err = s.Get("91", hour.Add(-48*time.Hour), now.Add(48*time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, buckets)
+	assert.Empty(t, points)
+}
+
+func TestStore_compact_alignsToEpoch(t *testing.T) {
+	// steps of 7m are aligned differently to the epoch and to the zero time
+	s, cleanup := openTestStore(t, StoreConfig{Retention: 48 * time.Hour, RawRetention: time.Hour, Step: 7 * time.Minute})
+	defer cleanup()
+	sensor := &SensorConfig{ID: "91"}
+	start := time.Unix(testTime.Unix()/420*420, 0).UTC()
+
+	require.NoError(t, s.Write(&Reading{Sensor: sensor, Temperature: 4, Humidity: 60, Time: start}))
+	require.NoError(t, s.Write(&Reading{Sensor: sensor, Temperature: 6, Humidity: 50,
+		Time: start.Add(6*time.Minute + 30*time.Second)}))
+
+	require.NoError(t, s.compact(start.Add(time.Hour+6*time.Minute+30*time.Second)))
+
+	buckets, points, err := s.Get("91", start, start.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, buckets, "Incomplete bucket is not downsampled")
+	assert.Len(t, points, 2)
+
+	require.NoError(t, s.compact(start.Add(time.Hour+7*time.Minute)))
+
+	buckets, points, err = s.Get("91", start, start.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, []HistoryBucket{{
+		Time:        start,
+		Count:       2,
+		Temperature: HistoryAggregate{Min: 4, Max: 6, Avg: 5},
+		Humidity:    HistoryAggregate{Min: 50, Max: 60, Avg: 55},
+	}}, buckets)
+	assert.Empty(t, points)
+}
+
+func TestHistoryHandler_store(t *testing.T) {
+	dir, err := ioutil.TempDir("", "weather-station")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := parseConfigString(`
+store:
+  path: ` + filepath.Join(dir, "readings.db") + `
+sensors:
+  91:
+    location: fridge
+    protocol: weather12
+`)
+	require.NoError(t, err)
+	e := newTestExporter(t, c)
+	defer e.store.Close()
+
+	hour := testTime.Truncate(time.Hour)
+	sensor := c.Sensors["91"]
+	require.NoError(t, e.store.Write(&Reading{Sensor: sensor, Temperature: 4, Humidity: 60, Time: hour}))
+	require.NoError(t, e.store.Write(&Reading{Sensor: sensor, Temperature: 6, Humidity: 50, Time: hour.Add(time.Minute)}))
+	require.NoError(t, e.store.compact(hour.Add(c.Store.RawRetention+time.Hour)))
+	require.NoError(t, e.store.Write(&Reading{Sensor: sensor, Temperature: 7, Humidity: 40, Time: hour.Add(time.Hour)}))
+
+	w := get(e, "/api/history?sensor=91&from=2019-10-06T21:00:00Z&to=2019-10-06T23:00:00Z")
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"sensor": "91", "location": "fridge",
+		"from": "2019-10-06T21:00:00Z", "to": "2019-10-06T23:00:00Z",
+		"points": [
+			{"time": "2019-10-06T21:00:00Z", "temperature": 5, "humidity": 55},
+			{"time": "2019-10-06T22:00:00Z", "temperature": 7, "humidity": 40}
+		]}`, w.Body.String())
+
+	w = get(e, "/api/history?sensor=91&from=2019-10-06T21:00:00Z&to=2019-10-06T23:00:00Z&step=2h")
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"sensor": "91", "location": "fridge",
+		"from": "2019-10-06T21:00:00Z", "to": "2019-10-06T23:00:00Z", "step": "2h0m0s",
+		"points": [
+			{"time": "2019-10-06T21:00:00Z", "count": 3,
+			 "temperature": {"min": 4, "max": 7, "avg": 5.666666666666667},
+			 "humidity": {"min": 40, "max": 60, "avg": 50}}
+		]}`, w.Body.String())
+
+	w = get(e, "/api/history?sensor=91&from=2019-10-06T21:00:00Z&to=2019-10-06T23:00:00Z&step=5m")
+
+	assert.Equal(t, http.StatusBadRequest, w.Code, "Buckets of the store can't be split")
+}
+
+func TestParseConfig_store(t *testing.T) {
+	c, err := parseConfigString(`
+store:
+  path: /var/lib/weather-station/readings.db
+`)
+	require.NoError(t, err)
+	assert.Equal(t, StoreConfig{Path: "/var/lib/weather-station/readings.db", Retention: 8760 * time.Hour,
+		RawRetention: 168 * time.Hour, Step: time.Hour}, c.Store)
+	assert.Equal(t, 1000, c.Sinks["store"].QueueSize)
+
+	_, err = parseConfigString(`
+store:
+  path: readings.db
+  retention: 24h
+  raw_retention: 48h
+  step: 0s
+`)
+	assert.EqualError(t, err, "store: raw retention must be positive and not exceed the retention, got 48h0m0s; "+
+		"store: step must be positive, got 0s")
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// The types of events sent to clients of the stream.
+const (
+	// StreamReading is a reading of a configured sensor
+	StreamReading = "reading"
+	// StreamSignal is a raw signal as read from the Arduino
+	StreamSignal = "signal"
+	// StreamUnknownSensor is a signal of a sensor that is not configured
+	StreamUnknownSensor = "unknown_sensor"
+)
+
+const (
+	// streamClientBuffer is the number of events buffered per client,
+	// further events are dropped until the client has caught up
+	streamClientBuffer = 64
+	// streamKeepAlive is the time between two comments sent to SSE clients,
+	// so that proxies don't close idle connections
+	streamKeepAlive = 30 * time.Second
+)
+
+// streamEvent is sent to clients as JSON object with type and data.
+type streamEvent struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+	// sensorID and location are matched against the filters of clients
+	sensorID string
+	location string
+}
+
+// RawSignal is a signal received by the Arduino before decoding.
+type RawSignal struct {
+	Signal string    `json:"signal"`
+	Time   time.Time `json:"time"`
+}
+
+// streamFilter selects the events sent to a client. Empty sensors or
+// locations match all, raw signals are never filtered by them.
+type streamFilter struct {
+	types     map[string]bool
+	sensors   map[string]bool
+	locations map[string]bool
+}
+
+// newStreamFilter parses the query parameters events, sensor and location,
+// which can be given multiple times or as comma-separated lists.
+func newStreamFilter(r *http.Request) (streamFilter, error) {
+	values := func(name string) map[string]bool {
+		set := map[string]bool{}
+		for _, v := range r.URL.Query()[name] {
+			for _, s := range strings.Split(v, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					set[s] = true
+				}
+			}
+		}
+		return set
+	}
+
+	f := streamFilter{
+		types:     values("events"),
+		sensors:   values("sensor"),
+		locations: values("location"),
+	}
+	if len(f.types) == 0 {
+		f.types[StreamReading] = true
+	}
+	for t := range f.types {
+		switch t {
+		case StreamReading, StreamSignal, StreamUnknownSensor:
+		default:
+			return f, fmt.Errorf("unknown event type %q (supported: %s, %s, %s)",
+				t, StreamReading, StreamSignal, StreamUnknownSensor)
+		}
+	}
+	return f, nil
+}
+
+func (f streamFilter) matches(ev streamEvent) bool {
+	if !f.types[ev.Type] {
+		return false
+	}
+	if ev.Type == StreamSignal {
+		return true
+	}
+	if len(f.sensors) > 0 && !f.sensors[ev.sensorID] {
+		return false
+	}
+	return len(f.locations) == 0 || f.locations[ev.location]
+}
+
+// streamHub sends events to all connected clients, whose filter matches.
+// It is a sink, so that every reading is sent as it has been received.
+type streamHub struct {
+	sync.Mutex
+	clients map[chan streamEvent]streamFilter
+}
+
+func newStreamHub() *streamHub {
+	return &streamHub{clients: map[chan streamEvent]streamFilter{}}
+}
+
+// Name identifies the stream as sink.
+func (h *streamHub) Name() string {
+	return "stream"
+}
+
+// Write publishes a reading to the clients following its sensor.
+func (h *streamHub) Write(r *Reading) error {
+	h.publish(streamEvent{
+		Type:     StreamReading,
+		Data:     sensorStatus(r.Sensor, r, r.Time),
+		sensorID: r.Sensor.ID,
+		location: r.Sensor.Location,
+	})
+	return nil
+}
+
+func (h *streamHub) signal(signal string, t time.Time) {
+	h.publish(streamEvent{Type: StreamSignal, Data: RawSignal{signal, t}})
+}
+
+func (h *streamHub) unknownSensor(s UnknownSensor) {
+	h.publish(streamEvent{Type: StreamUnknownSensor, Data: s, sensorID: s.ID})
+}
+
+// publish sends an event to all matching clients without waiting for slow ones.
+func (h *streamHub) publish(ev streamEvent) {
+	h.Lock()
+	defer h.Unlock()
+
+	for events, filter := range h.clients {
+		if !filter.matches(ev) {
+			continue
+		}
+		select {
+		case events <- ev:
+		default:
+		}
+	}
+}
+
+func (h *streamHub) subscribe(f streamFilter) chan streamEvent {
+	h.Lock()
+	defer h.Unlock()
+
+	events := make(chan streamEvent, streamClientBuffer)
+	h.clients[events] = f
+	return events
+}
+
+func (h *streamHub) unsubscribe(events chan streamEvent) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.clients, events)
+}
+
+// streamHandler streams events to clients as Server-Sent Events or, if
+// the connection is upgraded, as text messages of a WebSocket.
+func (e *Exporter) streamHandler(w http.ResponseWriter, r *http.Request) {
+	f, err := newStreamFilter(r)
+	if err != nil {
+		serveJSON(w, r, http.StatusBadRequest, apiError{err.Error()})
+		return
+	}
+
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		// unlike websocket.Handler, the server accepts clients of any origin,
+		// just like the rest of the API
+		websocket.Server{Handler: func(ws *websocket.Conn) {
+			e.streamWebSocket(ws, f)
+		}}.ServeHTTP(w, r)
+		return
+	}
+	e.streamSSE(w, r, f)
+}
+
+func (e *Exporter) streamSSE(w http.ResponseWriter, r *http.Request, f streamFilter) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		serveJSON(w, r, http.StatusInternalServerError, apiError{"streaming is not supported"})
+		return
+	}
+
+	events := e.stream.subscribe(f)
+	defer e.stream.unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// disable buffering of nginx
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case ev := <-events:
+			data, err := json.Marshal(ev.Data)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+		}
+		flusher.Flush()
+	}
+}
+
+func (e *Exporter) streamWebSocket(ws *websocket.Conn, f streamFilter) {
+	defer ws.Close()
+
+	events := e.stream.subscribe(f)
+	defer e.stream.unsubscribe(events)
+
+	// messages of the client are ignored, reading only detects that it has gone away
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		var msg []byte
+		for websocket.Message.Receive(ws, &msg) == nil {
+		}
+	}()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case ev := <-events:
+			if err := websocket.JSON.Send(ws, ev); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+)
+
+func TestStreamFilter(t *testing.T) {
+	r := httptest.NewRequest("GET", "/api/stream?events=reading,unknown_sensor&sensor=91&sensor=92", nil)
+	f, err := newStreamFilter(r)
+	require.NoError(t, err)
+
+	assert.True(t, f.matches(streamEvent{Type: StreamReading, sensorID: "91", location: "fridge"}))
+	assert.False(t, f.matches(streamEvent{Type: StreamReading, sensorID: "93", location: "fridge"}))
+	assert.True(t, f.matches(streamEvent{Type: StreamUnknownSensor, sensorID: "92"}))
+	assert.False(t, f.matches(streamEvent{Type: StreamSignal}), "Raw signals are not requested")
+
+	r = httptest.NewRequest("GET", "/api/stream?events=signal,reading&location=garden", nil)
+	f, err = newStreamFilter(r)
+	require.NoError(t, err)
+
+	assert.True(t, f.matches(streamEvent{Type: StreamReading, sensorID: "92", location: "garden"}))
+	assert.False(t, f.matches(streamEvent{Type: StreamReading, sensorID: "91", location: "fridge"}))
+	assert.True(t, f.matches(streamEvent{Type: StreamSignal}), "Raw signals are not filtered by location")
+}
+
+func TestStreamFilter_defaultsToReadings(t *testing.T) {
+	f, err := newStreamFilter(httptest.NewRequest("GET", "/api/stream", nil))
+	require.NoError(t, err)
+
+	assert.True(t, f.matches(streamEvent{Type: StreamReading, sensorID: "91"}))
+	assert.False(t, f.matches(streamEvent{Type: StreamUnknownSensor, sensorID: "91"}))
+}
+
+func TestStreamHandler_invalidEvents(t *testing.T) {
+	e := newTestAPIExporter(t)
+
+	w := get(e, "/api/stream?events=reading,frames")
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.JSONEq(t, `{"error": "unknown event type \"frames\" (supported: reading, signal, unknown_sensor)"}`,
+		w.Body.String())
+}
+
+// waitForClients waits until the given number of clients is connected to the stream.
+func waitForClients(t *testing.T, h *streamHub, n int) {
+	for i := 0; i < 100; i++ {
+		h.Lock()
+		connected := len(h.clients)
+		h.Unlock()
+		if connected == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %d connected clients", n)
+}
+
+func TestStreamHandler_sse(t *testing.T) {
+	e := newTestAPIExporter(t)
+	s := httptest.NewServer(e.Handler())
+	defer s.Close()
+
+	resp, err := http.Get(s.URL + "/api/stream?events=reading,signal&sensor=91")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	waitForClients(t, e.stream, 1)
+	e.handleReading(&Reading{Sensor: e.config.Sensors["92"], Temperature: 12, Humidity: 80, Time: testTime})
+	e.handleReading(&Reading{Sensor: e.config.Sensors["91"], Temperature: 4.2, Humidity: 60, Time: testTime})
+	e.DecodedSignal("RF receive 1008 576")
+
+	lines := bufio.NewScanner(resp.Body)
+	var received []string
+	for len(received) < 6 && lines.Scan() {
+		received = append(received, lines.Text())
+	}
+
+	require.Len(t, received, 6)
+	assert.Equal(t, "event: reading", received[0])
+	assert.True(t, strings.HasPrefix(received[1], "data: "))
+	var reading SensorStatus
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(received[1], "data: ")), &reading))
+	assert.Equal(t, "91", reading.ID, "Reading of sensor 92 is filtered")
+	assert.Equal(t, 4.2, *reading.Temperature)
+	assert.Equal(t, "", received[2])
+	assert.Equal(t, "event: signal", received[3])
+	assert.Contains(t, received[4], `"signal":"1008 576"`)
+}
+
+func TestStreamHandler_webSocket(t *testing.T) {
+	e := newTestAPIExporter(t)
+	s := httptest.NewServer(e.Handler())
+	defer s.Close()
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/api/stream?location=garden",
+		"", "http://tablet.local")
+	require.NoError(t, err)
+
+	waitForClients(t, e.stream, 1)
+	e.handleReading(&Reading{Sensor: e.config.Sensors["91"], Temperature: 4.2, Humidity: 60, Time: testTime})
+	e.handleReading(&Reading{Sensor: e.config.Sensors["92"], Temperature: 12, Humidity: 80, Time: testTime})
+
+	var ev struct {
+		Type string       `json:"type"`
+		Data SensorStatus `json:"data"`
+	}
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	require.NoError(t, websocket.JSON.Receive(ws, &ev))
+	assert.Equal(t, StreamReading, ev.Type)
+	assert.Equal(t, "garden", ev.Data.Location, "Reading in the fridge is filtered")
+	assert.Equal(t, 12.0, *ev.Data.Temperature)
+
+	ws.Close()
+	waitForClients(t, e.stream, 0)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/expfmt"
+)
+
+// textfileInterval is the time after which the textfile is rewritten without new readings,
+// so that sensors that are no longer received become stale.
+const textfileInterval = time.Minute
+
+// EnableTextfile makes the exporter write all metrics to the named file whenever a reading
+// has been received and periodically once the outputs are started, so that they can be exposed
+// by node_exporter's textfile collector instead of serving them via HTTP.
+func (e *Exporter) EnableTextfile(name string) error {
+	if filepath.Ext(name) != ".prom" {
+		return errors.Errorf("Textfile '%s' must have the extension .prom to be read by node_exporter", name)
+	}
+
+	e.textfile = name
+	e.dispatcher.add(textfileSink{e, name}, SinkConfig{})
+	return e.WriteTextfile(name)
+}
+
+func (e *Exporter) writeTextfilePeriodically(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := e.WriteTextfile(e.textfile); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// textfileSink writes all metrics to the textfile after every reading.
+type textfileSink struct {
+	exporter *Exporter
+	name     string
+}
+
+// Name identifies the textfile as sink.
+func (textfileSink) Name() string {
+	return "textfile"
+}
+
+// Write rewrites the textfile with the current metrics.
+func (s textfileSink) Write(*Reading) error {
+	return s.exporter.WriteTextfile(s.name)
+}
+
+// WriteTextfile atomically writes all metrics to the named file in the Prometheus text format.
+func (e *Exporter) WriteTextfile(name string) error {
+	families, err := e.gatherer().Gather()
+	if err != nil {
+		return errors.Wrap(err, "Failed to gather metrics")
+	}
+
+	var buf bytes.Buffer
+	for _, f := range families {
+		if _, err := expfmt.MetricFamilyToText(&buf, f); err != nil {
+			return errors.Wrap(err, "Failed to format metrics")
+		}
+	}
+	return writeFileAtomic(name, buf.Bytes())
+}
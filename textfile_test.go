@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnableTextfile(t *testing.T) {
+	AppFs = afero.NewMemMapFs()
+	c := loadSampleConfig()
+	c.Metrics.GoCollector = false
+	c.Metrics.ProcessCollector = false
+	e := newTestExporter(t, c)
+
+	require.NoError(t, e.EnableTextfile("/var/lib/node_exporter/weather-station.prom"))
+
+	data, err := afero.ReadFile(AppFs, "/var/lib/node_exporter/weather-station.prom")
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "meter_receiver_lines_read_total 0\n")
+	assert.NotContains(t, string(data), "meter_temperature_celsius")
+
+	e.handleReading(NewReading(c.Sensors["91"], &GTWT01Result{Temperature: 4.2, Humidity: 60}, time.Now()))
+
+	data, err = afero.ReadFile(AppFs, "/var/lib/node_exporter/weather-station.prom")
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `meter_temperature_celsius{id="91",location="fridge"} 4.2`+"\n")
+
+	files, _ := afero.ReadDir(AppFs, "/var/lib/node_exporter")
+	assert.Len(t, files, 1, "Temporary file has been renamed")
+}
+
+func TestWriteTextfile_readableByOthers(t *testing.T) {
+	AppFs = afero.NewOsFs()
+	dir, err := afero.TempDir(AppFs, "", "node_exporter")
+	require.NoError(t, err)
+	defer AppFs.RemoveAll(dir)
+	e := newTestExporter(t, loadSampleConfig())
+
+	require.NoError(t, e.WriteTextfile(filepath.Join(dir, "weather-station.prom")))
+
+	info, err := AppFs.Stat(filepath.Join(dir, "weather-station.prom"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm(), "node_exporter can read the file")
+}
+
+func TestEnableTextfile_invalidExtension(t *testing.T) {
+	AppFs = afero.NewMemMapFs()
+	e := newTestExporter(t, loadSampleConfig())
+
+	err := e.EnableTextfile("/var/lib/node_exporter/weather-station.txt")
+
+	assert.EqualError(t, err, "Textfile '/var/lib/node_exporter/weather-station.txt' "+
+		"must have the extension .prom to be read by node_exporter")
+	for _, q := range e.dispatcher.sinks {
+		assert.NotEqual(t, "textfile", q.sink.Name(), "Textfile sink has not been added")
+	}
+}
+
+func TestWriteTextfilePeriodically(t *testing.T) {
+	AppFs = afero.NewMemMapFs()
+	c := loadSampleConfig()
+	c.Sensors["91"].StaleTimeout = 100 * time.Millisecond
+	e := newTestExporter(t, c)
+	require.NoError(t, e.EnableTextfile("/var/lib/node_exporter/weather-station.prom"))
+	e.handleReading(NewReading(c.Sensors["91"], &GTWT01Result{Temperature: 4.2, Humidity: 60}, time.Now()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		e.writeTextfilePeriodically(ctx, 50*time.Millisecond)
+		close(done)
+	}()
+
+	time.Sleep(300 * time.Millisecond)
+	cancel()
+	<-done
+	data, err := afero.ReadFile(AppFs, "/var/lib/node_exporter/weather-station.prom")
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "meter_temperature_celsius",
+		"Values of stale sensors are removed without new readings")
+	assert.Contains(t, string(data), `meter_last_seen_timestamp_seconds{id="91",location="fridge"}`)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxUnknownSensors limits the size of the inventory, as signals
+// decoded with the wrong protocol result in lots of random IDs.
+const maxUnknownSensors = 256
+
+// IgnoreRule silences signals of sensors that are not configured,
+// e.g. the ones of neighbors. Protocol and channel are optional.
+type IgnoreRule struct {
+	ID       string `mapstructure:"id"`
+	Protocol string `mapstructure:"protocol"`
+	Channel  int    `mapstructure:"channel"`
+}
+
+// Matches checks whether a signal decoded with the given protocol is ignored.
+func (i IgnoreRule) Matches(protocol string, m *GTWT01Result) bool {
+	return i.ID == m.Name &&
+		(i.Protocol == "" || i.Protocol == protocol) &&
+		(i.Channel == 0 || i.Channel == m.Channel)
+}
+
+// UnknownSensor is a sensor that has been received, but is not configured.
+type UnknownSensor struct {
+	Protocol    string    `json:"protocol"`
+	ID          string    `json:"id"`
+	Channel     int       `json:"channel"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+	Count       int       `json:"count"`
+	Temperature float64   `json:"temperature"`
+	Humidity    int       `json:"humidity"`
+	LowBattery  bool      `json:"low_battery"`
+}
+
+type unknownSensorKey struct {
+	protocol string
+	id       string
+	channel  int
+}
+
+// UnknownSensors is an inventory of all sensors that have been received,
+// but are not configured, and is safe for concurrent use.
+type UnknownSensors struct {
+	sync.Mutex
+	sensors map[unknownSensorKey]*UnknownSensor
+}
+
+// NewUnknownSensors creates an empty inventory.
+func NewUnknownSensors() *UnknownSensors {
+	return &UnknownSensors{
+		sensors: map[unknownSensorKey]*UnknownSensor{},
+	}
+}
+
+// Add records a signal of an unknown sensor decoded with the given protocol and returns
+// a copy of its entry. If the inventory is full, the sensor seen least recently is evicted.
+func (u *UnknownSensors) Add(protocol string, m *GTWT01Result, t time.Time) UnknownSensor {
+	u.Lock()
+	defer u.Unlock()
+
+	key := unknownSensorKey{protocol, m.Name, m.Channel}
+	s, ok := u.sensors[key]
+	if !ok {
+		if len(u.sensors) >= maxUnknownSensors {
+			u.evict()
+		}
+		s = &UnknownSensor{
+			Protocol:  protocol,
+			ID:        m.Name,
+			Channel:   m.Channel,
+			FirstSeen: t,
+		}
+		u.sensors[key] = s
+	}
+
+	s.LastSeen = t
+	s.Count++
+	s.Temperature = m.Temperature
+	s.Humidity = m.Humidity
+	s.LowBattery = m.LowBattery
+	return *s
+}
+
+func (u *UnknownSensors) evict() {
+	var oldest unknownSensorKey
+	var evicted *UnknownSensor
+	for key, s := range u.sensors {
+		if evicted == nil || s.LastSeen.Before(evicted.LastSeen) {
+			oldest, evicted = key, s
+		}
+	}
+	delete(u.sensors, oldest)
+}
+
+// All returns copies of all unknown sensors, the most often seen first.
+func (u *UnknownSensors) All() []UnknownSensor {
+	u.Lock()
+	defer u.Unlock()
+
+	all := make([]UnknownSensor, 0, len(u.sensors))
+	for _, s := range u.sensors {
+		all = append(all, *s)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Count != all[j].Count {
+			return all[i].Count > all[j].Count
+		}
+		if all[i].Protocol != all[j].Protocol {
+			return all[i].Protocol < all[j].Protocol
+		}
+		return all[i].ID < all[j].ID
+	})
+	return all
+}
+
+// unknownSensorsHandler serves the inventory of unknown sensors as JSON.
+func (e *Exporter) unknownSensorsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(e.unknownSensors.All())
+	if err != nil {
+		log.Println(err)
+	}
+}
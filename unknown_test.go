@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnknownSensors_Add(t *testing.T) {
+	u := NewUnknownSensors()
+
+	u.Add("weather15", &GTWT01Result{ID: 2320, Name: "2320", Channel: 2, Temperature: 19.6, Humidity: 54}, testTime)
+	u.Add("weather12", &GTWT01Result{ID: 145, Name: "145", Channel: 1, Temperature: -178, Humidity: 33}, testTime)
+	u.Add("weather15", &GTWT01Result{ID: 2320, Name: "2320", Channel: 2, Temperature: 19.8, Humidity: 55,
+		LowBattery: true}, testTime.Add(time.Minute))
+
+	all := u.All()
+	require.Len(t, all, 2)
+	assert.Equal(t, UnknownSensor{
+		Protocol:    "weather15",
+		ID:          "2320",
+		Channel:     2,
+		FirstSeen:   testTime,
+		LastSeen:    testTime.Add(time.Minute),
+		Count:       2,
+		Temperature: 19.8,
+		Humidity:    55,
+		LowBattery:  true,
+	}, all[0])
+	assert.Equal(t, "145", all[1].ID)
+}
+
+func TestUnknownSensors_evictsLeastRecentlySeen(t *testing.T) {
+	u := NewUnknownSensors()
+
+	for i := 0; i < maxUnknownSensors; i++ {
+		u.Add("weather12", &GTWT01Result{Name: strconv.Itoa(i)}, testTime.Add(time.Duration(i)*time.Second))
+	}
+	u.Add("weather12", &GTWT01Result{Name: "0"}, testTime.Add(time.Hour))
+
+	u.Add("weather12", &GTWT01Result{Name: "new"}, testTime.Add(time.Hour))
+
+	all := u.All()
+	assert.Len(t, all, maxUnknownSensors)
+	for _, s := range all {
+		assert.NotEqual(t, "1", s.ID, "Sensor seen least recently has been evicted")
+	}
+}
+
+func TestIgnoreRule_Matches(t *testing.T) {
+	m := &GTWT01Result{ID: 145, Name: "145", Channel: 1}
+
+	assert.True(t, IgnoreRule{ID: "145"}.Matches("weather12", m))
+	assert.True(t, IgnoreRule{ID: "145", Protocol: "weather12", Channel: 1}.Matches("weather12", m))
+	assert.False(t, IgnoreRule{ID: "146"}.Matches("weather12", m))
+	assert.False(t, IgnoreRule{ID: "145", Protocol: "weather15"}.Matches("weather12", m))
+	assert.False(t, IgnoreRule{ID: "145", Channel: 2}.Matches("weather12", m))
+}
+
+func TestUnknownSensorsHandler(t *testing.T) {
+	e := newTestExporter(t, loadSampleConfig())
+	e.unknownSensors.Add("weather15", &GTWT01Result{ID: 2320, Name: "2320", Channel: 2}, testTime)
+
+	w := httptest.NewRecorder()
+	e.unknownSensorsHandler(w, httptest.NewRequest("GET", "/api/unknown-sensors", nil))
+
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var sensors []UnknownSensor
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &sensors))
+	require.Len(t, sensors, 1)
+	assert.Equal(t, "2320", sensors[0].ID)
+	assert.Contains(t, w.Body.String(), `"first_seen":"2019-10-06T21:29:28Z"`)
+}
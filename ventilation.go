@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Placements of a sensor (see config option placement).
+const (
+	Indoor  = "indoor"
+	Outdoor = "outdoor"
+)
+
+// VentilationConfig configures when ventilation is recommended.
+type VentilationConfig struct {
+	// MinDifference is the minimum difference in g/m³ between indoor and outdoor
+	// absolute humidity for which opening the windows is worth it
+	MinDifference float64 `mapstructure:"min_difference"`
+}
+
+// VentilationSummary compares the absolute humidity of all indoor sensors
+// with the one of the outdoor sensor.
+type VentilationSummary struct {
+	Outdoor *AbsoluteHumidityReading `json:"outdoor"`
+	Rooms   []VentilationAdvice      `json:"rooms"`
+}
+
+// AbsoluteHumidityReading is the absolute humidity of a sensor at a point in time.
+type AbsoluteHumidityReading struct {
+	ID               string    `json:"id"`
+	Location         string    `json:"location"`
+	AbsoluteHumidity float64   `json:"absolute_humidity"`
+	Time             time.Time `json:"time"`
+}
+
+// VentilationAdvice tells whether opening the windows will dry a room, i.e.
+// whether the indoor air contains more water than the outdoor air.
+type VentilationAdvice struct {
+	AbsoluteHumidityReading
+	// Difference is the indoor minus the outdoor absolute humidity in g/m³
+	Difference  float64 `json:"difference"`
+	Recommended bool    `json:"recommended"`
+}
+
+// ventilationSummary compares the latest readings of all indoor sensors with the
+// latest reading of the outdoor sensor, ignoring stale readings.
+// Rooms are empty as long as there is no outdoor reading.
+func ventilationSummary(c *Config, rs *Readings, now time.Time) *VentilationSummary {
+	summary := &VentilationSummary{
+		Rooms: []VentilationAdvice{},
+	}
+
+	var indoor []*Reading
+	for _, id := range c.SensorIDs() {
+		r := rs.Get(id)
+		if r == nil || r.Stale(now) {
+			continue
+		}
+		switch c.Sensors[id].Placement {
+		case Outdoor:
+			summary.Outdoor = absoluteHumidityReading(r)
+		case Indoor:
+			indoor = append(indoor, r)
+		}
+	}
+
+	if summary.Outdoor == nil {
+		return summary
+	}
+
+	for _, r := range indoor {
+		a := absoluteHumidityReading(r)
+		diff := a.AbsoluteHumidity - summary.Outdoor.AbsoluteHumidity
+		summary.Rooms = append(summary.Rooms, VentilationAdvice{
+			AbsoluteHumidityReading: *a,
+			Difference:              diff,
+			Recommended:             diff >= c.Ventilation.MinDifference,
+		})
+	}
+
+	return summary
+}
+
+func absoluteHumidityReading(r *Reading) *AbsoluteHumidityReading {
+	return &AbsoluteHumidityReading{
+		ID:               r.Sensor.ID,
+		Location:         r.Sensor.Location,
+		AbsoluteHumidity: absoluteHumidity(r.Temperature, r.Humidity),
+		Time:             r.Time,
+	}
+}
+
+// ventilationHandler serves the ventilation summary as JSON.
+func (e *Exporter) ventilationHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(ventilationSummary(e.config, e.readings, time.Now()))
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVentilationSummary(t *testing.T) {
+	c := ventilationConfig(t)
+	rs := NewReadings()
+
+	summary := ventilationSummary(c, rs, testTime)
+	assert.Nil(t, summary.Outdoor)
+	assert.Empty(t, summary.Rooms, "No advice without outdoor reading")
+
+	rs.Set(&Reading{Sensor: c.Sensors["1"], Temperature: 5, Humidity: 90, Time: testTime})
+	rs.Set(&Reading{Sensor: c.Sensors["2"], Temperature: 15, Humidity: 70, Time: testTime})
+	rs.Set(&Reading{Sensor: c.Sensors["3"], Temperature: 22, Humidity: 35, Time: testTime})
+	rs.Set(&Reading{Sensor: c.Sensors["4"], Temperature: 4, Humidity: 80, Time: testTime})
+
+	summary = ventilationSummary(c, rs, testTime)
+	require.NotNil(t, summary.Outdoor)
+	assert.Equal(t, "garden", summary.Outdoor.Location)
+	assert.InDelta(t, 6.1, summary.Outdoor.AbsoluteHumidity, 0.1)
+
+	require.Len(t, summary.Rooms, 2)
+	assert.Equal(t, "basement", summary.Rooms[0].Location)
+	assert.InDelta(t, 2.9, summary.Rooms[0].Difference, 0.1)
+	assert.True(t, summary.Rooms[0].Recommended)
+	assert.Equal(t, "office", summary.Rooms[1].Location)
+	assert.InDelta(t, 0.7, summary.Rooms[1].Difference, 0.1)
+	assert.False(t, summary.Rooms[1].Recommended)
+}
+
+func TestVentilationSummary_ignoresStaleReadings(t *testing.T) {
+	c := ventilationConfig(t)
+	rs := NewReadings()
+
+	rs.Set(&Reading{Sensor: c.Sensors["1"], Temperature: 5, Humidity: 90, Time: testTime})
+	rs.Set(&Reading{Sensor: c.Sensors["2"], Temperature: 15, Humidity: 70, Time: testTime.Add(time.Hour)})
+
+	summary := ventilationSummary(c, rs, testTime.Add(time.Hour))
+	assert.Nil(t, summary.Outdoor, "Outdoor reading is stale")
+	assert.Empty(t, summary.Rooms)
+}
+
+func TestVentilationHandler(t *testing.T) {
+	c := ventilationConfig(t)
+	e := newTestExporter(t, c)
+
+	now := time.Now()
+	e.handleReading(&Reading{Sensor: c.Sensors["1"], Temperature: 5, Humidity: 90, Time: now})
+	e.handleReading(&Reading{Sensor: c.Sensors["2"], Temperature: 15, Humidity: 70, Time: now})
+
+	assert.Equal(t, `# HELP meter_ventilation_recommended Whether opening the windows will dry the room (1) or not (0)
+# TYPE meter_ventilation_recommended gauge
+meter_ventilation_recommended{id="2",location="basement"} 1
+`, gatherText(t, e, "meter_ventilation_recommended"))
+
+	w := httptest.NewRecorder()
+	e.ventilationHandler(w, httptest.NewRequest("GET", "/api/ventilation", nil))
+
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var summary VentilationSummary
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &summary))
+	assert.Equal(t, "1", summary.Outdoor.ID)
+	require.Len(t, summary.Rooms, 1)
+	assert.Equal(t, "basement", summary.Rooms[0].Location)
+	assert.InDelta(t, 2.9, summary.Rooms[0].Difference, 0.1)
+	assert.True(t, summary.Rooms[0].Recommended)
+	assert.Contains(t, w.Body.String(), `"absolute_humidity":`)
+}
+
+func TestParseConfig_invalidPlacement(t *testing.T) {
+	_, err := parseConfigString(`
+sensors:
+  1:
+    location: garden
+    protocol: weather15
+    placement: outdoor
+  2:
+    location: balcony
+    protocol: weather15
+    placement: outdoor
+  3:
+    location: office
+    protocol: weather15
+    placement: inside
+`)
+
+	assert.EqualError(t, err, "sensor id 2 is placed outdoor, but sensor id 1 is already; "+
+		`sensor id 3 has invalid placement "inside" (supported: indoor, outdoor)`)
+}
+
+func ventilationConfig(t *testing.T) *Config {
+	c, err := parseConfigString(`
+sensors:
+  1:
+    location: garden
+    protocol: weather15
+    placement: outdoor
+  2:
+    location: basement
+    protocol: weather15
+    placement: indoor
+  3:
+    location: office
+    protocol: weather15
+    placement: indoor
+  4:
+    location: fridge
+    protocol: weather12
+`)
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, c.Ventilation.MinDifference, "Default minimum difference")
+
+	return c
+}